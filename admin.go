@@ -0,0 +1,81 @@
+package logscraper
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+/*
+The admin API is a small HTTP server that lets operators inspect and control a running
+scraper. It is off unless Scraper.AdminAddr is set, and because it has no authentication,
+it should only ever listen on a loopback address.
+
+	GET  /status  The ScraperStatus, as JSON
+	POST /pause   Suspend reading and delivery
+	POST /resume  Undo /pause
+	POST /reload  Apply changes to the configuration file. Responds with 400 if the new configuration is invalid.
+*/
+
+func (s *Scraper) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		s.writeJson(w, s.Status())
+	})
+	mux.HandleFunc("/pause", s.adminAction(s.Pause))
+	mux.HandleFunc("/resume", s.adminAction(s.Resume))
+	mux.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := s.Reload(); err != nil {
+			http.Error(w, s.secrets.redact(err.Error()), http.StatusBadRequest)
+			return
+		}
+		s.writeJson(w, s.Status())
+	})
+	return mux
+}
+
+// Wrap a control function in a handler that only accepts POST, and responds with the new status
+func (s *Scraper) adminAction(action func()) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		action()
+		s.writeJson(w, s.Status())
+	}
+}
+
+// Respond with v as JSON, with any secrets redacted
+func (s *Scraper) writeJson(w http.ResponseWriter, v interface{}) {
+	raw, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(s.secrets.redact(string(raw)) + "\n"))
+}
+
+// Serve the admin API until ctx is cancelled
+func (s *Scraper) runAdmin(ctx context.Context) {
+	server := &http.Server{
+		Addr:    s.AdminAddr,
+		Handler: s.adminHandler(),
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	s.logMetaf("Admin API listening on %v", s.AdminAddr)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		s.logMetaf("Admin API failed: %v", err)
+	}
+}
@@ -0,0 +1,35 @@
+package logscraper
+
+import (
+	"reflect"
+	"testing"
+)
+
+// A message whose routing key can't be rendered is dropped, without holding up the others
+func TestAmqpPrepare(t *testing.T) {
+	routingKey := `{{if eq .Source \"bad\"}}{{template \"missing\"}}{{end}}{{.Source}}.{{.Level}}`
+	messages := []*LogMsg{
+		{Source: []byte("a"), Severity: []byte("E"), Message: []byte("one")},
+		{Source: []byte("bad"), Severity: []byte("E"), Message: []byte("two")},
+		{Source: []byte("b"), Severity: []byte("I"), Message: []byte("three")},
+		{Source: []byte("a"), Severity: []byte("E"), Message: []byte("four")},
+	}
+	cases := []struct {
+		mode string
+		keys []string
+	}{
+		{amqpModeMessage, []string{"a.error", "b.info", "a.error"}},
+		{amqpModeBatch, []string{"a.error", "b.info"}},
+	}
+	for _, c := range cases {
+		s := NewScraper("host", "ownhost", "", "")
+		relay := newTestRelay(t, s, `{"name": "amqp", "type": "amqp", "url": "amqp://localhost", "mode": "`+c.mode+`", "routingKey": "`+routingKey+`"}`)
+		var keys []string
+		for _, p := range relay.(*AmqpRelay).prepare(messages) {
+			keys = append(keys, p.key)
+		}
+		if !reflect.DeepEqual(keys, c.keys) {
+			t.Errorf("%v: published with keys %v, expected %v", c.mode, keys, c.keys)
+		}
+	}
+}
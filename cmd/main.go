@@ -1,24 +1,66 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"github.com/IMQS/logscraper"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 )
 
 func main() {
 
 	ownhostname, _ := os.Hostname()
-	s := logscraper.NewScraper(getHostname(), ownhostname, "c:/imqsvar/logs/scraper-state.json", "c:/imqsvar/logs/scraper.log")
-	logscraper.InitialiseRelayers(s)
+	// The paths are filled in once we've parsed the flags and read the config
+	s := logscraper.NewScraper("", ownhostname, "", "")
 
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(validate(s, os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "secrets" {
+		os.Exit(secrets(os.Args[2:]))
+	}
+
+	var paths logscraper.Paths
 	conffile := flag.String("config", "", "Config file location")
+	flag.StringVar(&paths.StateFile, "statefile", "", "Where to store our state. Overrides $"+logscraper.EnvStateFile+" and the config.")
+	flag.StringVar(&paths.MetaLog, "metalog", "", "Where to log about ourselves. Overrides $"+logscraper.EnvMetaLog+" and the config.")
+	flag.StringVar(&paths.HostnameFile, "hostnamefile", "", "File that holds our hostname. Overrides $"+logscraper.EnvHostnameFile+" and the config.")
+	flag.StringVar(&paths.DatadogConfig, "datadogconfig", "", "The Datadog agent's config file. Overrides $"+logscraper.EnvDatadogConfig+" and the config.")
+	flag.StringVar(&paths.Keystore, "keystore", "", "Our encrypted secrets. Overrides $"+logscraper.EnvKeystore+" and the config.")
+	flag.StringVar(&paths.MachineKey, "machinekey", "", "The key that the keystore is encrypted with. Overrides $"+logscraper.EnvMachineKey+" and the config.")
+	watch := flag.Bool("watch", true, "React to log file changes as they happen, instead of only polling")
+	concurrency := flag.Int("concurrency", s.MaxConcurrency, "Maximum number of log files that are scanned at the same time")
+	maxLineSize := flag.Int("maxlinesize", s.MaxLineSize, "Lines longer than this many bytes are truncated")
+	stateBackend := flag.String("statestore", s.StateBackend, "Where to keep our state (json or bolt)")
+	adminAddr := flag.String("admin", "", "Listen address of the admin API, eg 127.0.0.1:2016. Disabled if empty.")
+	watchConfig := flag.Bool("watchconfig", true, "Reload the config file whenever it changes")
 	flag.Parse()
 
-	err := s.LoadConfiguration(*conffile)
+	paths, err := logscraper.ResolvePaths(paths, *conffile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.Hostname = getHostname(paths.HostnameFile)
+	s.StateFilename = paths.StateFile
+	s.SetMetaLogFile(paths.MetaLog)
+	s.DatadogConfig = paths.DatadogConfig
+	s.SetKeystore(paths.Keystore, paths.MachineKey)
+	logscraper.InitialiseRelayers(s)
+
+	s.Watch = *watch
+	s.MaxConcurrency = *concurrency
+	s.MaxLineSize = *maxLineSize
+	s.StateBackend = *stateBackend
+	s.AdminAddr = *adminAddr
+	s.WatchConfig = *watchConfig
+
+	err = s.LoadConfiguration(*conffile)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -26,17 +68,116 @@ func main() {
 	// Comment out the following line when debugging
 	s.SendToLoggly = true
 
-	run := func() {
-		s.Run()
+	run := func(ctx context.Context) {
+		s.Run(ctx)
+	}
+	if !logscraper.RunAsService(run, s) {
+		// run in foreground, until we're asked to stop
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		logscraper.HandleControlSignals(ctx, s)
+		run(ctx)
+	}
+}
+
+// Check a config file, and print its problems. Returns the exit code, which is 0 if the config is valid.
+//
+//	logscraper validate [-config file] [file]
+func validate(s *logscraper.Scraper, args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	conffile := flags.String("config", "", "Config file location")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		*conffile = flags.Arg(0)
+	}
+	if *conffile == "" {
+		fmt.Fprintf(os.Stderr, "No config file specified\n")
+		return 2
+	}
+	// If the config cannot be loaded, the validation tells us why
+	if paths, err := logscraper.ResolvePaths(logscraper.Paths{}, *conffile); err == nil {
+		s.DatadogConfig = paths.DatadogConfig
+		s.SetKeystore(paths.Keystore, paths.MachineKey)
+	}
+
+	diags, err := s.ValidateConfiguration(*conffile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+	errors := 0
+	for _, d := range diags {
+		fmt.Printf("%v:%v\n", *conffile, d)
+		if !d.Warning {
+			errors++
+		}
+	}
+	if errors != 0 {
+		fmt.Printf("%v: %v errors\n", *conffile, errors)
+		return 1
+	}
+	fmt.Printf("%v: OK\n", *conffile)
+	return 0
+}
+
+// Manage the secrets in the keystore. Returns the exit code.
+//
+//	logscraper secrets [-config file] [-keystore file] [-machinekey file] list
+//	logscraper secrets [...] set NAME    (the value is read from stdin)
+//	logscraper secrets [...] delete NAME
+func secrets(args []string) int {
+	var paths logscraper.Paths
+	flags := flag.NewFlagSet("secrets", flag.ExitOnError)
+	conffile := flags.String("config", "", "Config file location, if the keystore is set in there")
+	flags.StringVar(&paths.Keystore, "keystore", "", "Keystore location")
+	flags.StringVar(&paths.MachineKey, "machinekey", "", "Machine key location")
+	flags.Parse(args)
+
+	if *conffile != "" {
+		var err error
+		if paths, err = logscraper.ResolvePaths(paths, *conffile); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 2
+		}
+	} else {
+		paths = paths.Or(logscraper.PathsFromEnv()).Or(logscraper.DefaultPaths())
+	}
+
+	ks, err := logscraper.OpenKeystore(paths.Keystore, paths.MachineKey)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	cmd := flags.Arg(0)
+	name := flags.Arg(1)
+	switch {
+	case cmd == "list" && flags.NArg() == 1:
+		for _, name := range ks.Names() {
+			fmt.Println(name)
+		}
+		return 0
+	case cmd == "set" && flags.NArg() == 2:
+		value, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		ks.Set(name, strings.TrimRight(string(value), "\r\n"))
+	case cmd == "delete" && flags.NArg() == 2:
+		ks.Delete(name)
+	default:
+		fmt.Fprintf(os.Stderr, "Usage: logscraper secrets [flags] list | set NAME | delete NAME\n")
+		return 2
 	}
-	if !logscraper.RunAsService(run) {
-		// run in foreground
-		run()
+	if err := ks.Save(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
 	}
+	return 0
 }
 
-func getHostname() string {
-	if hfile, err := ioutil.ReadFile("c:/imqsbin/conf/hostname"); err == nil && len(hfile) != 0 {
+func getHostname(filename string) string {
+	if hfile, err := ioutil.ReadFile(filename); err == nil && len(hfile) != 0 {
 		line := string(hfile)
 		if strings.Index(line, "http://") == 0 {
 			return line[7:]
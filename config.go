@@ -1,6 +1,7 @@
 package logscraper
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 
@@ -24,12 +25,62 @@ const (
 
 type ServiceRegistryConfig struct {
 	Services []struct {
-		Logs []struct {
-			Name     string `json:"name"`
-			Filename string `json:"filename"`
-			Parser   string `json:"parser"`
-		} `json:"logs"`
+		Logs []LogConfig `json:"logs"`
 	} `json:"services"`
+	Relays []RelayConfig `json:"relays,omitempty"` // If empty, we use the relays set up by InitialiseRelayers
+	Paths  Paths         `json:"paths,omitempty"`  // See ResolvePaths. These are not reloaded.
+}
+
+type LogConfig struct {
+	Name          string `json:"name"`
+	Filename      string `json:"filename"`
+	Parser        string `json:"parser"`                  // A key of parsersByName
+	MaxLineSize   int    `json:"maxLineSize,omitempty"`   // Optional, in bytes
+	Encoding      string `json:"encoding,omitempty"`      // Optional. One of auto (the default), utf-8, utf-16le, utf-16be, windows-1252
+	StartPosition string `json:"startPosition,omitempty"` // Optional. Where to start a file that we have no state for. See parseStartPolicy.
+}
+
+// RelayConfig is the definition of a single relay. Apart from the name and type, each type of
+// relay has its own settings, which its factory in relayFactories reads with Decode.
+type RelayConfig struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"` // A key of relayFactories
+	raw     json.RawMessage
+	secrets *secretResolver // Resolves the secrets that the settings refer to. See secretResolver.
+}
+
+func (rc *RelayConfig) UnmarshalJSON(b []byte) error {
+	type plain RelayConfig
+	if err := json.Unmarshal(b, (*plain)(rc)); err != nil {
+		return err
+	}
+	rc.raw = append(json.RawMessage(nil), b...)
+	return nil
+}
+
+// Decode the type-specific settings of the relay into v, with any secret references resolved
+func (rc *RelayConfig) Decode(v interface{}) error {
+	if len(rc.raw) == 0 {
+		return nil
+	}
+	raw := rc.raw
+	if rc.secrets != nil {
+		var err error
+		if raw, err = rc.secrets.resolveJson(raw); err != nil {
+			return err
+		}
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// Returns a canonical form of the relay's definition, so that we can tell whether it has changed
+func (rc *RelayConfig) definition() string {
+	var v interface{}
+	if err := json.Unmarshal(rc.raw, &v); err != nil {
+		return string(rc.raw)
+	}
+	canonical, _ := json.Marshal(v) // maps are marshalled with sorted keys
+	return string(canonical)
 }
 
 func LoadServiceRegistryConfig(filename string) (*ServiceRegistryConfig, error) {
@@ -53,13 +104,37 @@ func (config *ServiceRegistryConfig) LogSources() ([]*LogSource, []error) {
 
 	for _, v := range config.Services {
 		for _, s := range v.Logs {
+			enc, err := lookupEncoding(s.Encoding)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", s.Name, err))
+				continue
+			}
+			policy, err := parseStartPolicy(s.StartPosition)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", s.Name, err))
+				continue
+			}
 			if _, ok := parsersByName[s.Parser]; ok {
-				logSources = append(logSources, NewLogSource(s.Name, s.Filename, parsersByName[s.Parser]))
+				src := NewLogSource(s.Name, s.Filename, parsersByName[s.Parser])
+				src.ParserName = s.Parser
+				src.MaxLineSize = s.MaxLineSize
+				src.encoding = enc
+				src.StartPolicy = policy
+				src.definition = fmt.Sprintf("%+v", s)
+				logSources = append(logSources, src)
 			} else {
 				errs = append(errs, fmt.Errorf("%s has parser %s which cannot be found", s.Name, s.Parser))
 			}
 		}
 	}
 
+	names := make(map[string]bool)
+	for _, src := range logSources {
+		if names[src.Name] {
+			errs = append(errs, fmt.Errorf("There is more than one log named %s", src.Name))
+		}
+		names[src.Name] = true
+	}
+
 	return logSources, errs
 }
@@ -0,0 +1,155 @@
+package logscraper
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+The controller lets the outside world (the Windows service manager, signals, and the admin
+API) suspend and resume the scraper, and reload its configuration. While paused, no worker starts a pass, so we neither
+read our log files nor deliver anything to the relays. The pollers and watchers keep on
+running, and their wake-ups are merged into one pending pass per source, which runs as soon
+as we resume. Positions are untouched, so nothing is lost or sent twice.
+*/
+
+// Controller is implemented by Scraper
+type Controller interface {
+	// Stop reading and delivering. This waits for passes that are already busy to finish.
+	Pause()
+	Resume()
+	// Apply changes to the configuration file. If the new configuration is invalid, then we keep on
+	// running with the old one.
+	Reload() error
+	Status() ScraperStatus
+}
+
+type ScraperStatus struct {
+	Paused      bool
+	PausedSince *time.Time `json:",omitempty"`
+	Sources     []SourceStatus
+}
+
+type SourceStatus struct {
+	Name     string
+	Filename string
+	Parser   string
+	Position int64
+	Relays   map[string]int64 `json:",omitempty"` // Position up to which each relay has accepted our messages
+}
+
+type controller struct {
+	lock        sync.Mutex
+	idle        *sync.Cond // Signalled when active drops to zero
+	paused      bool
+	pausedSince time.Time
+	resumed     chan struct{} // Closed while we are running
+	active      int           // Number of passes in progress
+}
+
+func newController() *controller {
+	c := &controller{}
+	c.idle = sync.NewCond(&c.lock)
+	c.resumed = make(chan struct{})
+	close(c.resumed)
+	return c
+}
+
+// Wait until we are not paused, and then register the start of a pass. Returns false if done or
+// retire is closed while we wait. Every successful call must be matched by a call to leave().
+func (c *controller) enter(done, retire <-chan struct{}) bool {
+	for {
+		c.lock.Lock()
+		if !c.paused {
+			c.active++
+			c.lock.Unlock()
+			return true
+		}
+		resumed := c.resumed
+		c.lock.Unlock()
+		select {
+		case <-done:
+			return false
+		case <-retire:
+			return false
+		case <-resumed:
+		}
+	}
+}
+
+func (c *controller) leave() {
+	c.lock.Lock()
+	c.active--
+	if c.active == 0 {
+		c.idle.Broadcast()
+	}
+	c.lock.Unlock()
+}
+
+func (c *controller) isPaused() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.paused
+}
+
+func (c *controller) pause() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.paused {
+		return false
+	}
+	c.paused = true
+	c.pausedSince = time.Now()
+	c.resumed = make(chan struct{})
+	for c.active != 0 {
+		c.idle.Wait()
+	}
+	return true
+}
+
+func (c *controller) resume() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.paused {
+		return false
+	}
+	c.paused = false
+	close(c.resumed)
+	return true
+}
+
+func (s *Scraper) Pause() {
+	if s.control.pause() {
+		s.logMetaf("Scraper paused")
+	}
+}
+
+func (s *Scraper) Resume() {
+	if s.control.resume() {
+		s.logMetaf("Scraper resumed")
+	}
+}
+
+func (s *Scraper) Status() ScraperStatus {
+	s.control.lock.Lock()
+	status := ScraperStatus{
+		Paused: s.control.paused,
+	}
+	if s.control.paused {
+		since := s.control.pausedSince
+		status.PausedSince = &since
+	}
+	s.control.lock.Unlock()
+
+	for _, src := range s.sourceList() {
+		st := src.snapshot()
+		status.Sources = append(status.Sources, SourceStatus{
+			Name:     src.Name,
+			Filename: src.Filename,
+			Parser:   src.ParserName,
+			Position: st.LastPos,
+			Relays:   st.Relays,
+		})
+	}
+	return status
+}
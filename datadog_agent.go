@@ -0,0 +1,144 @@
+package logscraper
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The parts of the Datadog agent's datadog.yaml that we care about
+type datadogAgentConfig struct {
+	ApiKey   string             `yaml:"api_key"`
+	Hostname string             `yaml:"hostname"`
+	Site     string             `yaml:"site"`   // eg datadoghq.eu. Defaults to datadoghq.com.
+	DDURL    string             `yaml:"dd_url"` // Overrides site
+	Proxy    datadogProxyConfig `yaml:"proxy"`
+	Tags     datadogTags        `yaml:"tags"`
+}
+
+type datadogProxyConfig struct {
+	HTTP    string   `yaml:"http"`
+	HTTPS   string   `yaml:"https"`
+	NoProxy []string `yaml:"no_proxy"`
+}
+
+func readDatadogAgentConfig(filename string) (*datadogAgentConfig, error) {
+	raw, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &datadogAgentConfig{}
+	if err := yaml.Unmarshal(raw, cfg); err != nil {
+		return nil, fmt.Errorf("Unable to parse %v: %v", filename, err)
+	}
+	return cfg, nil
+}
+
+// Older agents accept tags as a single string, separated by commas or spaces, instead of a list
+type datadogTags []string
+
+func (t *datadogTags) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.SequenceNode {
+		var list []string
+		if err := value.Decode(&list); err != nil {
+			return err
+		}
+		*t = list
+		return nil
+	}
+	var str string
+	if err := value.Decode(&str); err != nil {
+		return err
+	}
+	*t = strings.FieldsFunc(str, func(r rune) bool { return r == ',' || r == ' ' })
+	return nil
+}
+
+// Returns the URL of the events API, based on site and dd_url
+func (c *datadogAgentConfig) eventsURL() string {
+	if c.DDURL != "" {
+		return strings.TrimRight(c.DDURL, "/") + "/api/v1/events"
+	}
+	if c.Site != "" {
+		return "https://api." + c.Site + "/api/v1/events"
+	}
+	return datadogEventsURL
+}
+
+// Returns the URL of the logs intake, based on site. Unlike events, logs don't go to dd_url.
+func (c *datadogAgentConfig) logsURL() string {
+	site := c.Site
+	if site == "" {
+		site = "datadoghq.com"
+	}
+	return "https://http-intake.logs." + site + "/api/v2/logs"
+}
+
+// Returns a client that goes through the proxies in cfg, or nil if there are none
+func (cfg *datadogProxyConfig) client() (*http.Client, error) {
+	if cfg.HTTP == "" && cfg.HTTPS == "" {
+		return nil, nil
+	}
+	parse := func(raw string) (*url.URL, error) {
+		if raw == "" {
+			return nil, nil
+		}
+		u, err := url.Parse(raw)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid Datadog proxy %v: %v", raw, err)
+		}
+		return u, nil
+	}
+	httpProxy, err := parse(cfg.HTTP)
+	if err != nil {
+		return nil, err
+	}
+	httpsProxy, err := parse(cfg.HTTPS)
+	if err != nil {
+		return nil, err
+	}
+	noProxy := cfg.NoProxy
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = func(req *http.Request) (*url.URL, error) {
+		if bypassProxy(req.URL.Hostname(), noProxy) {
+			return nil, nil
+		}
+		if req.URL.Scheme == "https" {
+			return httpsProxy, nil
+		}
+		return httpProxy, nil
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// Returns true if host matches one of the entries of no_proxy, which are either hostnames (which
+// also match their subdomains), domains with a leading dot, IP addresses, or CIDR ranges
+func bypassProxy(host string, noProxy []string) bool {
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+	for _, entry := range noProxy {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			return true
+		}
+		if _, cidr, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		domain := strings.TrimPrefix(entry, ".")
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
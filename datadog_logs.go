@@ -0,0 +1,260 @@
+package logscraper
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+/*
+DatadogLogsRelay sends every message to the Datadog logs intake (as opposed to DatadogReceiver,
+which only raises events for errors, for alerting). Messages are sent as JSON arrays, gzipped,
+in as few requests as the intake's limits allow:
+
+	- At most 1000 entries per request
+	- At most 5MB per request, before compression
+	- At most 1MB per entry. Longer messages are cut short, and marked as truncated.
+
+Each entry's ddsource is the format of its log (eg go, java), its service is the name of its
+log source, and its status is the message's Level.
+*/
+
+const (
+	datadogLogsMaxEntries = 1000
+	datadogLogsMaxPayload = 5 * 1024 * 1024
+	datadogLogsMaxEntry   = 1024 * 1024
+	datadogLogsTimeout    = 30 * time.Second
+)
+
+type DatadogLogsRelay struct {
+	s        *Scraper
+	URL      string
+	ApiKey   string
+	Host     string   // Overrides the host of the messages, if not empty
+	Service  string   // Overrides the name of the log source, if not empty
+	Tags     []string // Added to every entry
+	Compress bool
+	client   *http.Client
+}
+
+type datadogLogEntry struct {
+	Message          string `json:"message"`
+	Status           string `json:"status,omitempty"`
+	Timestamp        int64  `json:"timestamp"` // Milliseconds since the epoch
+	Hostname         string `json:"hostname,omitempty"`
+	Service          string `json:"service,omitempty"`
+	DDSource         string `json:"ddsource,omitempty"`
+	DDTags           string `json:"ddtags,omitempty"`
+	OwnHostname      string `json:"ownhostname,omitempty"`
+	Severity         string `json:"severity,omitempty"` // As it appears in the log
+	ProcessID        string `json:"process_id,omitempty"`
+	ThreadID         string `json:"thread_id,omitempty"`
+	ClientIP         string `json:"client_ip,omitempty"`
+	Request          string `json:"request,omitempty"`
+	ResponseCode     string `json:"response_code,omitempty"`
+	ResponseBytes    string `json:"response_bytes,omitempty"`
+	ResponseDuration string `json:"response_duration,omitempty"`
+	JavaClass        string `json:"java_class,omitempty"`
+	Truncated        bool   `json:"truncated,omitempty"`
+}
+
+var datadogLogStatuses = map[Level]string{
+	LevelTrace:   "debug",
+	LevelDebug:   "debug",
+	LevelInfo:    "info",
+	LevelWarning: "warning",
+	LevelError:   "error",
+	LevelFatal:   "critical",
+}
+
+/*
+Creates a Datadog logs relay from its definition in config. As with the events relay, if no API
+key is given, we read it (and the site, proxy and tags) from the Datadog agent's configuration.
+*/
+func newDatadogLogsRelay(s *Scraper, cfg *RelayConfig) (Relay, error) {
+	opt := struct {
+		URL            string   `json:"url"`  // Overrides site
+		Site           string   `json:"site"` // eg datadoghq.eu
+		ApiKey         string   `json:"apiKey"`
+		Host           string   `json:"host"`
+		Service        string   `json:"service"`
+		Tags           []string `json:"tags"`
+		Compress       *bool    `json:"compress"` // Defaults to true
+		AgentConfig    string   `json:"agentConfig"`
+		TimeoutSeconds int      `json:"timeoutSeconds"`
+	}{
+		AgentConfig:    s.DatadogConfig,
+		TimeoutSeconds: int(datadogLogsTimeout / time.Second),
+	}
+	if err := cfg.Decode(&opt); err != nil {
+		return nil, err
+	}
+	if opt.TimeoutSeconds <= 0 {
+		return nil, fmt.Errorf("Invalid Datadog logs timeoutSeconds %v", opt.TimeoutSeconds)
+	}
+	dl := &DatadogLogsRelay{
+		s:        s,
+		ApiKey:   opt.ApiKey,
+		Host:     opt.Host,
+		Service:  opt.Service,
+		Compress: opt.Compress == nil || *opt.Compress,
+		client:   &http.Client{},
+	}
+	agent := &datadogAgentConfig{Site: opt.Site}
+	if dl.ApiKey == "" {
+		var err error
+		if agent, err = readDatadogAgentConfig(opt.AgentConfig); err != nil {
+			return nil, err
+		}
+		if agent.ApiKey == "" {
+			return nil, errors.New("No Datadog API key found")
+		}
+		dl.ApiKey = strings.TrimSpace(agent.ApiKey)
+		s.secrets.track(dl.ApiKey)
+		if opt.Site != "" {
+			agent.Site = opt.Site
+		}
+		if dl.Host == "" {
+			dl.Host = strings.TrimSpace(agent.Hostname)
+		}
+		dl.Tags = agent.Tags
+		client, err := agent.Proxy.client()
+		if err != nil {
+			return nil, err
+		}
+		if client != nil {
+			dl.client = client
+		}
+	}
+	dl.client.Timeout = time.Duration(opt.TimeoutSeconds) * time.Second
+	dl.URL = agent.logsURL()
+	if opt.URL != "" {
+		dl.URL = opt.URL
+	}
+	dl.Tags = append(dl.Tags, opt.Tags...)
+	return dl, nil
+}
+
+/*
+Sends the messages in as many batches as the intake's limits require. If a batch fails, we give
+up on the rest, and return the error.
+*/
+func (dl *DatadogLogsRelay) Send(messages []*LogMsg) error {
+	var batch [][]byte
+	size := 2
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := dl.post(batch)
+		batch = nil
+		size = 2
+		return err
+	}
+	for _, m := range messages {
+		entry, err := dl.encode(m)
+		if err != nil {
+			dl.s.logMetaf("Unable to encode message for Datadog logs: %v", err)
+			continue
+		}
+		if len(batch) == datadogLogsMaxEntries || size+len(entry)+1 > datadogLogsMaxPayload {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		batch = append(batch, entry)
+		size += len(entry) + 1
+	}
+	return flush()
+}
+
+// Encode the message as an intake entry, cutting it short if it exceeds the size limit of entries
+func (dl *DatadogLogsRelay) encode(m *LogMsg) ([]byte, error) {
+	e := datadogLogEntry{
+		Message:          string(m.Message),
+		Status:           datadogLogStatuses[m.Level()],
+		Timestamp:        m.Time.UnixNano() / 1e6,
+		Hostname:         string(m.Host),
+		Service:          string(m.Source),
+		DDSource:         string(m.Format),
+		DDTags:           strings.Join(dl.Tags, ","),
+		OwnHostname:      string(m.OwnHostname),
+		Severity:         string(m.Severity),
+		ProcessID:        string(m.ProcessID),
+		ThreadID:         string(m.ThreadID),
+		ClientIP:         string(m.ClientIP),
+		Request:          string(m.Request),
+		ResponseCode:     string(m.ResponseCode),
+		ResponseBytes:    string(m.ResponseBytes),
+		ResponseDuration: string(m.ResponseDuration),
+		JavaClass:        string(m.JavaClass),
+		Truncated:        m.Truncated,
+	}
+	if dl.Host != "" {
+		e.Hostname = dl.Host
+	}
+	if dl.Service != "" {
+		e.Service = dl.Service
+	}
+	for {
+		raw, err := json.Marshal(&e)
+		if err != nil || len(raw) <= datadogLogsMaxEntry {
+			return raw, err
+		}
+		// Escaping can make the message longer once it is encoded, so we may need a few rounds
+		excess := len(raw) - datadogLogsMaxEntry
+		if excess >= len(e.Message) {
+			return nil, errors.New("Message is too large, even without its text")
+		}
+		cut := len(e.Message) - excess
+		for cut > 0 && !utf8.RuneStart(e.Message[cut]) {
+			cut--
+		}
+		e.Message = e.Message[:cut]
+		e.Truncated = true
+	}
+}
+
+func (dl *DatadogLogsRelay) post(batch [][]byte) error {
+	body := &bytes.Buffer{}
+	var w io.Writer = body
+	var zw *gzip.Writer
+	if dl.Compress {
+		zw = gzip.NewWriter(body)
+		w = zw
+	}
+	w.Write([]byte("["))
+	w.Write(bytes.Join(batch, []byte(",")))
+	w.Write([]byte("]"))
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest("POST", dl.URL, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("DD-API-KEY", dl.ApiKey)
+	if dl.Compress {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	resp, err := dl.client.Do(req)
+	if err != nil {
+		dl.s.logMetaf("Error posting logs to Datadog: %v", err)
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return checkResponse(resp)
+}
@@ -0,0 +1,358 @@
+package logscraper
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+/*
+ElasticRelay writes messages to Elasticsearch or OpenSearch, through the _bulk API. Each message
+becomes a document in the index named by the relay's index template, eg
+
+	logs-{source}-{date:2006.01.02}
+
+where {source}, {host} and {format} are those of the message, and {date:LAYOUT} is the message's
+time (in UTC) in a Go time layout. Index names are lower-cased, as Elasticsearch requires.
+
+The bulk response tells us the outcome of each document. Documents that failed for transient
+reasons (429 or 5xx) are retried, with back-off, up to MaxRetries times. Documents that were
+rejected outright (eg a mapping conflict) are logged and dropped, since sending them again
+won't help.
+*/
+
+const (
+	elasticMaxBatchBytes = 5 * 1024 * 1024
+	elasticDefaultIndex  = "logscraper-{date:2006.01.02}"
+	elasticTimeout       = 30 * time.Second
+)
+
+type ElasticRelay struct {
+	s          *Scraper
+	URL        string // eg https://localhost:9200
+	Index      *indexTemplate
+	Pipeline   string // Ingest pipeline, if not empty
+	Username   string // For basic auth
+	Password   string
+	ApiKey     string // The encoded API key (base64 of id:key), which takes precedence over basic auth
+	MaxRetries int
+	RetryDelay time.Duration // Doubled after every retry
+	client     *http.Client
+}
+
+type elasticDoc struct {
+	Timestamp        string `json:"@timestamp"`
+	Message          string `json:"message"`
+	Level            string `json:"level,omitempty"`    // Normalized, see Level
+	Severity         string `json:"severity,omitempty"` // As it appears in the log
+	Host             string `json:"host,omitempty"`
+	OwnHostname      string `json:"ownhostname,omitempty"`
+	Source           string `json:"source"`
+	Format           string `json:"format,omitempty"`
+	ProcessID        string `json:"process_id,omitempty"`
+	ThreadID         string `json:"thread_id,omitempty"`
+	ClientIP         string `json:"client_ip,omitempty"`
+	Request          string `json:"request,omitempty"`
+	ResponseCode     string `json:"response_code,omitempty"`
+	ResponseBytes    string `json:"response_bytes,omitempty"`
+	ResponseDuration string `json:"response_duration,omitempty"`
+	JavaClass        string `json:"java_class,omitempty"`
+	Truncated        bool   `json:"truncated,omitempty"`
+}
+
+// A document, and the bulk action line that goes before it
+type elasticItem struct {
+	action []byte
+	doc    []byte
+}
+
+type elasticBulkResponse struct {
+	Errors bool
+	Items  []map[string]struct {
+		Status int
+		Error  json.RawMessage
+	}
+}
+
+func newElasticRelay(s *Scraper, cfg *RelayConfig) (Relay, error) {
+	opt := struct {
+		URL                string `json:"url"`
+		Index              string `json:"index"`
+		Pipeline           string `json:"pipeline"`
+		Username           string `json:"username"`
+		Password           string `json:"password"`
+		ApiKey             string `json:"apiKey"`
+		MaxRetries         *int   `json:"maxRetries"`
+		TimeoutSeconds     int    `json:"timeoutSeconds"`
+		InsecureSkipVerify bool   `json:"insecureSkipVerify"` // For nodes with self-signed certificates
+	}{
+		Index:          elasticDefaultIndex,
+		TimeoutSeconds: int(elasticTimeout / time.Second),
+	}
+	if err := cfg.Decode(&opt); err != nil {
+		return nil, err
+	}
+	if opt.URL == "" {
+		return nil, errors.New("No Elasticsearch URL specified")
+	}
+	if _, err := url.Parse(opt.URL); err != nil {
+		return nil, fmt.Errorf("Invalid Elasticsearch URL: %v", err)
+	}
+	if opt.Username != "" && opt.Password == "" {
+		return nil, errors.New("No password specified for Elasticsearch user " + opt.Username)
+	}
+	if opt.TimeoutSeconds <= 0 {
+		return nil, fmt.Errorf("Invalid Elasticsearch timeoutSeconds %v", opt.TimeoutSeconds)
+	}
+	index, err := parseIndexTemplate(opt.Index)
+	if err != nil {
+		return nil, err
+	}
+	er := &ElasticRelay{
+		s:          s,
+		URL:        strings.TrimRight(opt.URL, "/"),
+		Index:      index,
+		Pipeline:   opt.Pipeline,
+		Username:   opt.Username,
+		Password:   opt.Password,
+		ApiKey:     opt.ApiKey,
+		MaxRetries: 3,
+		RetryDelay: time.Second,
+	}
+	if opt.MaxRetries != nil {
+		er.MaxRetries = *opt.MaxRetries
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if opt.InsecureSkipVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	er.client = &http.Client{Transport: transport, Timeout: time.Duration(opt.TimeoutSeconds) * time.Second}
+	return er, nil
+}
+
+func (er *ElasticRelay) Send(messages []*LogMsg) error {
+	var batch []elasticItem
+	size := 0
+	for _, m := range messages {
+		item, err := er.encode(m)
+		if err != nil {
+			er.s.logMetaf("Unable to encode message for Elasticsearch: %v", err)
+			continue
+		}
+		itemSize := len(item.action) + len(item.doc) + 2
+		if len(batch) != 0 && size+itemSize > elasticMaxBatchBytes {
+			if err := er.sendBatch(batch); err != nil {
+				return err
+			}
+			batch = nil
+			size = 0
+		}
+		batch = append(batch, item)
+		size += itemSize
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+	return er.sendBatch(batch)
+}
+
+func (er *ElasticRelay) encode(m *LogMsg) (elasticItem, error) {
+	doc := elasticDoc{
+		Timestamp:        m.Time.UTC().Format(time.RFC3339Nano),
+		Message:          string(m.Message),
+		Level:            m.Level().String(),
+		Severity:         string(m.Severity),
+		Host:             string(m.Host),
+		OwnHostname:      string(m.OwnHostname),
+		Source:           string(m.Source),
+		Format:           string(m.Format),
+		ProcessID:        string(m.ProcessID),
+		ThreadID:         string(m.ThreadID),
+		ClientIP:         string(m.ClientIP),
+		Request:          string(m.Request),
+		ResponseCode:     string(m.ResponseCode),
+		ResponseBytes:    string(m.ResponseBytes),
+		ResponseDuration: string(m.ResponseDuration),
+		JavaClass:        string(m.JavaClass),
+		Truncated:        m.Truncated,
+	}
+	raw, err := json.Marshal(&doc)
+	if err != nil {
+		return elasticItem{}, err
+	}
+	// "create" rather than "index", so that we can write to data streams too
+	action := map[string]map[string]string{"create": {"_index": er.Index.expand(m)}}
+	actionRaw, err := json.Marshal(action)
+	if err != nil {
+		return elasticItem{}, err
+	}
+	return elasticItem{action: actionRaw, doc: raw}, nil
+}
+
+// Send a batch, and retry the items that failed for transient reasons
+func (er *ElasticRelay) sendBatch(items []elasticItem) error {
+	delay := er.RetryDelay
+	for attempt := 0; ; attempt++ {
+		retry, err := er.bulk(items)
+		if err == nil && len(retry) == 0 {
+			return nil
+		}
+		if err == nil {
+			err = fmt.Errorf("%v of %v documents were not accepted by Elasticsearch", len(retry), len(items))
+			items = retry
+		}
+		if isPermanent(err) || attempt >= er.MaxRetries {
+			er.s.logMetaf("Error sending to Elasticsearch: %v", err)
+			return err
+		}
+		// Don't hold up a shutdown. The batch is sent again when we next start.
+		timer := time.NewTimer(delay)
+		select {
+		case <-er.s.stopping:
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
+
+// Post the items to _bulk. Returns the items that should be retried. If the request as a whole
+// failed, then the error is a permanentError if retrying won't help.
+func (er *ElasticRelay) bulk(items []elasticItem) ([]elasticItem, error) {
+	body := &bytes.Buffer{}
+	for _, item := range items {
+		body.Write(item.action)
+		body.WriteByte('\n')
+		body.Write(item.doc)
+		body.WriteByte('\n')
+	}
+	u := er.URL + "/_bulk"
+	if er.Pipeline != "" {
+		u += "?pipeline=" + url.QueryEscape(er.Pipeline)
+	}
+	req, err := http.NewRequest("POST", u, body)
+	if err != nil {
+		return nil, permanentError{err}
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if er.ApiKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+er.ApiKey)
+	} else if er.Username != "" {
+		req.SetBasicAuth(er.Username, er.Password)
+	}
+
+	resp, err := er.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkResponse(resp); err != nil {
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+			return nil, err
+		}
+		return nil, permanentError{fmt.Errorf("%v: %v", err, truncateString(string(raw), 500))}
+	}
+
+	var result elasticBulkResponse
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return nil, permanentError{fmt.Errorf("Unable to parse bulk response: %v", err)}
+	}
+	if !result.Errors {
+		return nil, nil
+	}
+	if len(result.Items) != len(items) {
+		return nil, permanentError{fmt.Errorf("Bulk response has %v items, but we sent %v", len(result.Items), len(items))}
+	}
+	var retry []elasticItem
+	dropped := 0
+	var firstError json.RawMessage
+	for i, outcome := range result.Items {
+		for _, status := range outcome {
+			switch {
+			case status.Status < 300:
+			case status.Status == http.StatusTooManyRequests || status.Status >= 500:
+				retry = append(retry, items[i])
+			default:
+				dropped++
+				if firstError == nil {
+					firstError = status.Error
+				}
+			}
+		}
+	}
+	if dropped != 0 {
+		er.s.logMetaf("Elasticsearch rejected %v documents. The first error was: %s", dropped, firstError)
+	}
+	return retry, nil
+}
+
+// The name of an index, with placeholders for the fields of a message. See ElasticRelay.
+type indexTemplate struct {
+	parts []indexPart
+}
+
+type indexPart struct {
+	literal string
+	field   string // source, host, format or date
+	layout  string // For date
+}
+
+func parseIndexTemplate(tmpl string) (*indexTemplate, error) {
+	t := &indexTemplate{}
+	for len(tmpl) != 0 {
+		open := strings.IndexByte(tmpl, '{')
+		if open < 0 {
+			t.parts = append(t.parts, indexPart{literal: tmpl})
+			break
+		}
+		if open != 0 {
+			t.parts = append(t.parts, indexPart{literal: tmpl[:open]})
+		}
+		end := strings.IndexByte(tmpl[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("Index %v has a { without a }", tmpl)
+		}
+		placeholder := tmpl[open+1 : open+end]
+		tmpl = tmpl[open+end+1:]
+		switch {
+		case placeholder == "source" || placeholder == "host" || placeholder == "format":
+			t.parts = append(t.parts, indexPart{field: placeholder})
+		case strings.HasPrefix(placeholder, "date:") && len(placeholder) > len("date:"):
+			t.parts = append(t.parts, indexPart{field: "date", layout: placeholder[len("date:"):]})
+		default:
+			return nil, fmt.Errorf("Unknown placeholder {%v} in index. Expected {source}, {host}, {format} or {date:LAYOUT}", placeholder)
+		}
+	}
+	return t, nil
+}
+
+func (t *indexTemplate) expand(m *LogMsg) string {
+	var b strings.Builder
+	for _, p := range t.parts {
+		switch p.field {
+		case "":
+			b.WriteString(p.literal)
+		case "source":
+			b.Write(m.Source)
+		case "host":
+			b.Write(m.Host)
+		case "format":
+			b.Write(m.Format)
+		case "date":
+			b.WriteString(m.Time.UTC().Format(p.layout))
+		}
+	}
+	return strings.ToLower(b.String())
+}
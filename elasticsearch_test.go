@@ -0,0 +1,74 @@
+package logscraper
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestElasticRetries(t *testing.T) {
+	cases := []struct {
+		name       string
+		maxRetries int
+		statuses   []int // Of each request, after which we respond with 200
+		requests   int32
+		fail       bool
+		permanent  bool
+	}{
+		{name: "accepted", maxRetries: 1, requests: 1},
+		{name: "retried", maxRetries: 2, statuses: []int{503, 429}, requests: 3},
+		{name: "out of retries", maxRetries: 1, statuses: []int{503, 503, 503}, requests: 2, fail: true},
+		{name: "rejected", maxRetries: 1, statuses: []int{400}, requests: 1, fail: true, permanent: true},
+	}
+	for _, c := range cases {
+		var requests int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := atomic.AddInt32(&requests, 1)
+			if int(n) <= len(c.statuses) {
+				w.WriteHeader(c.statuses[n-1])
+				return
+			}
+			w.Write([]byte(`{"errors": false, "items": [{"create": {"status": 201}}]}`))
+		}))
+		s := NewScraper("host", "ownhost", "", "")
+		relay := newTestRelay(t, s, fmt.Sprintf(`{"name": "es", "type": "elasticsearch", "url": "%v", "maxRetries": %v}`, server.URL, c.maxRetries))
+		relay.(*ElasticRelay).RetryDelay = time.Millisecond
+		err := relay.Send([]*LogMsg{{Message: []byte("one")}})
+		server.Close()
+		if (err != nil) != c.fail {
+			t.Errorf("%v: Send returned %v", c.name, err)
+		}
+		if requests != c.requests {
+			t.Errorf("%v: made %v requests, expected %v", c.name, requests, c.requests)
+		}
+		if isPermanent(err) != c.permanent {
+			t.Errorf("%v: returned %v, which is permanent: %v", c.name, err, isPermanent(err))
+		}
+	}
+}
+
+// Backing off before a retry must not hold up a shutdown
+func TestElasticBackoffStopsOnShutdown(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	s := NewScraper("host", "ownhost", "", "")
+	relay := newTestRelay(t, s, `{"name": "es", "type": "elasticsearch", "url": "`+server.URL+`"}`)
+	relay.(*ElasticRelay).RetryDelay = time.Minute
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		close(s.stopping)
+	}()
+	start := time.Now()
+	if err := relay.Send([]*LogMsg{{Message: []byte("one")}}); err == nil {
+		t.Error("Send succeeded, although Elasticsearch is unavailable")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Send took %v to notice the shutdown", elapsed)
+	}
+}
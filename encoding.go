@@ -0,0 +1,109 @@
+package logscraper
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+)
+
+/*
+Some Windows services write their logs as UTF-16 (usually with a BOM), and some older
+ones write Windows-1252. Our parsers are all byte-oriented regexes that expect UTF-8,
+so we split the raw file into lines using the newline sequence of the file's encoding,
+and decode each line to UTF-8 before parsing it.
+
+We never decode the file as a stream, because LogSource.lastPos must always refer to a
+position in the original file, and the lines are the only places where we know that the
+raw and decoded positions agree.
+*/
+type textEncoding struct {
+	name    string
+	unit    int    // Size of a code unit. Newlines are only recognized on a multiple of this.
+	newline []byte // "\n" in this encoding
+	cr      []byte // "\r" in this encoding, which we strip from the end of lines
+	bom     []byte
+	charset encoding.Encoding // nil for UTF-8, which needs no decoding
+}
+
+var (
+	encodingUTF8        = &textEncoding{name: "utf-8", unit: 1, newline: []byte("\n"), cr: []byte("\r"), bom: []byte{0xef, 0xbb, 0xbf}}
+	encodingUTF16LE     = &textEncoding{name: "utf-16le", unit: 2, newline: []byte{'\n', 0}, cr: []byte{'\r', 0}, bom: []byte{0xff, 0xfe}, charset: unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM)}
+	encodingUTF16BE     = &textEncoding{name: "utf-16be", unit: 2, newline: []byte{0, '\n'}, cr: []byte{0, '\r'}, bom: []byte{0xfe, 0xff}, charset: unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM)}
+	encodingWindows1252 = &textEncoding{name: "windows-1252", unit: 1, newline: []byte("\n"), cr: []byte("\r"), charset: charmap.Windows1252}
+)
+
+// Encodings that can be named in the "encoding" field of a log. An empty name means "auto".
+var encodingsByName = map[string]*textEncoding{
+	"auto":         nil,
+	"utf-8":        encodingUTF8,
+	"utf8":         encodingUTF8,
+	"utf-16le":     encodingUTF16LE,
+	"utf-16be":     encodingUTF16BE,
+	"windows-1252": encodingWindows1252,
+	"cp1252":       encodingWindows1252,
+}
+
+// Returns the encoding named in config. nil means that the encoding must be detected from the BOM.
+func lookupEncoding(name string) (*textEncoding, error) {
+	if name == "" {
+		return nil, nil
+	}
+	enc, ok := encodingsByName[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("Unknown encoding %v", name)
+	}
+	return enc, nil
+}
+
+// Returns the encoding described by the BOM at the start of head, or nil if there is no BOM
+func detectBOM(head []byte) *textEncoding {
+	for _, enc := range []*textEncoding{encodingUTF8, encodingUTF16LE, encodingUTF16BE} {
+		if bytes.HasPrefix(head, enc.bom) {
+			return enc
+		}
+	}
+	return nil
+}
+
+// Figure out the encoding of the file, and the length of its BOM (which is zero if there is none).
+// This is done on every pass, because a rolled log could come back in a different encoding.
+func (src *LogSource) detectEncoding(file *os.File) (*textEncoding, int) {
+	head := make([]byte, 4)
+	n, _ := file.ReadAt(head, 0)
+	head = head[:n]
+	bom := detectBOM(head)
+	enc := src.encoding
+	if enc == nil {
+		enc = bom
+	}
+	if enc == nil {
+		return encodingUTF8, 0
+	}
+	if bom == enc {
+		return enc, len(enc.bom)
+	}
+	return enc, 0
+}
+
+// Decode a raw line to UTF-8. The result never aliases raw. The encodings are shared by all of
+// the workers, and decoders have state, so each call gets a decoder of its own.
+func (enc *textEncoding) decode(raw []byte) []byte {
+	if enc.charset == nil {
+		line := make([]byte, len(raw))
+		copy(line, raw)
+		return line
+	}
+	line, err := enc.charset.NewDecoder().Bytes(raw)
+	if err != nil {
+		// The decoders replace invalid input, so this shouldn't happen, but we'd rather have
+		// mangled text than nothing.
+		line = make([]byte, len(raw))
+		copy(line, raw)
+	}
+	return line
+}
@@ -0,0 +1,125 @@
+package logscraper
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"testing"
+
+	"golang.org/x/text/encoding/unicode"
+)
+
+func utf16le(s string) []byte {
+	raw, _ := unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM).NewEncoder().Bytes([]byte(s))
+	return raw
+}
+
+func utf16be(s string) []byte {
+	raw, _ := unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM).NewEncoder().Bytes([]byte(s))
+	return raw
+}
+
+func TestEncodedLines(t *testing.T) {
+	cases := []struct {
+		name     string
+		enc      *textEncoding
+		raw      []byte
+		maxLine  int
+		lines    []string
+		consumed []int64 // After each line
+	}{
+		{
+			name:     "utf-16le with crlf",
+			enc:      encodingUTF16LE,
+			raw:      utf16le("ab\r\ncd\n"),
+			lines:    []string{"ab", "cd"},
+			consumed: []int64{8, 14},
+		},
+		{
+			name:     "utf-16be",
+			enc:      encodingUTF16BE,
+			raw:      utf16be("ab\ncd\n"),
+			lines:    []string{"ab", "cd"},
+			consumed: []int64{6, 12},
+		},
+		{
+			// U+0A41 U+4100 is 41 0a 00 41, which holds a newline at an odd offset
+			name:     "utf-16le newline across code units",
+			enc:      encodingUTF16LE,
+			raw:      utf16le("ੁ䄀\n"),
+			lines:    []string{"ੁ䄀"},
+			consumed: []int64{6},
+		},
+		{
+			// U+4100 U+0A41 is 41 00 0a 41
+			name:     "utf-16be newline across code units",
+			enc:      encodingUTF16BE,
+			raw:      utf16be("䄀ੁ\n"),
+			lines:    []string{"䄀ੁ"},
+			consumed: []int64{6},
+		},
+		{
+			name:     "utf-16le with a dangling byte",
+			enc:      encodingUTF16LE,
+			raw:      append(utf16le("ab\ncd"), 'e'),
+			lines:    []string{"ab", "cd�"},
+			consumed: []int64{6, 11},
+		},
+		{
+			// An odd maximum is rounded down, so that we never cut a code unit in half
+			name:     "utf-16le truncated to an odd length",
+			enc:      encodingUTF16LE,
+			raw:      utf16le("abcdef\ngh\n"),
+			maxLine:  5,
+			lines:    []string{"ab", "gh"},
+			consumed: []int64{8, 20},
+		},
+		{
+			name:     "windows-1252",
+			enc:      encodingWindows1252,
+			raw:      []byte("caf\xe9 \x80\n"),
+			lines:    []string{"café €"},
+			consumed: []int64{7},
+		},
+	}
+	for _, c := range cases {
+		scanner := bufio.NewScanner(bytes.NewReader(c.raw))
+		splitter := newLineSplitter(c.maxLine, c.enc)
+		splitter.attach(scanner)
+		var lines []string
+		var consumed []int64
+		for scanner.Scan() {
+			lines = append(lines, string(c.enc.decode(scanner.Bytes())))
+			consumed = append(consumed, splitter.consumed)
+		}
+		if err := scanner.Err(); err != nil {
+			t.Errorf("%v: %v", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(lines, c.lines) {
+			t.Errorf("%v: got lines %q, expected %q", c.name, lines, c.lines)
+		}
+		if !reflect.DeepEqual(consumed, c.consumed) {
+			t.Errorf("%v: consumed %v, expected %v", c.name, consumed, c.consumed)
+		}
+	}
+}
+
+func TestDetectBOM(t *testing.T) {
+	cases := []struct {
+		head     []byte
+		expected *textEncoding
+	}{
+		{[]byte{0xef, 0xbb, 0xbf, 'a'}, encodingUTF8},
+		{[]byte{0xff, 0xfe, 'a', 0}, encodingUTF16LE},
+		{[]byte{0xfe, 0xff, 0, 'a'}, encodingUTF16BE},
+		{[]byte{0xff}, nil},
+		{[]byte("abc"), nil},
+		{nil, nil},
+	}
+	for _, c := range cases {
+		if enc := detectBOM(c.head); enc != c.expected {
+			t.Errorf("detectBOM(% x) = %v, expected %v", c.head, enc, c.expected)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package logscraper
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+/*
+FileRelay writes messages to a local file, one line per message, for sites that have nowhere to
+send their logs but still want them gathered in one place, and as a predictable sink when
+testing parsers end to end. The encoding of each line is one of fileEncoders:
+
+	json    Our normalized form of a message (the default)
+	gelf    GELF 1.1, as sent by GelfRelay
+	syslog  RFC 5424, as sent by SyslogRelay
+	otlp    An OTLP/JSON request per line, which the collector's otlpjsonfile receiver reads
+
+The file is rotated by lumberjack when it reaches maxSizeMB, and if rotateEvery is "hour" or
+"day", also when the hour or day changes. Rotated files are named after the time of rotation.
+*/
+
+const (
+	fileRelayWriteChunk = 256 * 1024 // We collect lines into writes of about this size
+	fileRotateHour      = "hour"
+	fileRotateDay       = "day"
+)
+
+// Each encoder returns a message as a single line, without the line ending
+var fileEncoders = map[string]func(m *LogMsg) ([]byte, error){
+	"json": encodeFileJson,
+	"gelf": func(m *LogMsg) ([]byte, error) {
+		return json.Marshal(gelfFromLogMsg(m))
+	},
+	"syslog": func(m *LogMsg) ([]byte, error) {
+		sr := &SyslogRelay{Facility: syslogFacilities["local0"], SDID: syslogDefaultSDID}
+		// Continuation lines would otherwise read as messages of their own
+		return bytes.Replace(sr.format(m), []byte("\n"), []byte("\\n"), -1), nil
+	},
+	"otlp": func(m *LogMsg) ([]byte, error) {
+		return encodeOtlpJson((&OtlpRelay{}).resources([]*LogMsg{m})), nil
+	},
+}
+
+type FileRelay struct {
+	s           *Scraper
+	Path        string
+	Encoding    string // A key of fileEncoders
+	RotateEvery string // Empty, fileRotateHour or fileRotateDay
+	LocalTime   bool   // Use local time for rotation and the names of rotated files, instead of UTC
+	encode      func(m *LogMsg) ([]byte, error)
+	lock        sync.Mutex
+	out         *lumberjack.Logger
+	period      string // The hour or day of the current file, if RotateEvery is not empty
+}
+
+type fileJsonRecord struct {
+	Time             string `json:"time"`
+	Level            string `json:"level,omitempty"`    // Normalized, see Level
+	Severity         string `json:"severity,omitempty"` // As it appears in the log
+	Host             string `json:"host,omitempty"`
+	OwnHostname      string `json:"ownhostname,omitempty"`
+	Source           string `json:"source"`
+	Format           string `json:"format,omitempty"`
+	Message          string `json:"message"`
+	ProcessID        string `json:"process_id,omitempty"`
+	ThreadID         string `json:"thread_id,omitempty"`
+	ClientIP         string `json:"client_ip,omitempty"`
+	Request          string `json:"request,omitempty"`
+	ResponseCode     string `json:"response_code,omitempty"`
+	ResponseBytes    string `json:"response_bytes,omitempty"`
+	ResponseDuration string `json:"response_duration,omitempty"`
+	JavaClass        string `json:"java_class,omitempty"`
+	TraceID          string `json:"trace_id,omitempty"`
+	SpanID           string `json:"span_id,omitempty"`
+	Truncated        bool   `json:"truncated,omitempty"`
+}
+
+func newFileRelay(s *Scraper, cfg *RelayConfig) (Relay, error) {
+	opt := struct {
+		Path        string `json:"path"`
+		Encoding    string `json:"encoding"`
+		MaxSizeMB   int    `json:"maxSizeMB"`
+		MaxBackups  int    `json:"maxBackups"` // Zero keeps them all, unless maxAgeDays removes them
+		MaxAgeDays  int    `json:"maxAgeDays"` // Zero keeps them regardless of age
+		Compress    bool   `json:"compress"`   // gzip rotated files
+		RotateEvery string `json:"rotateEvery"`
+		LocalTime   bool   `json:"localTime"`
+	}{
+		Encoding:   "json",
+		MaxSizeMB:  100,
+		MaxBackups: 10,
+	}
+	if err := cfg.Decode(&opt); err != nil {
+		return nil, err
+	}
+	if opt.Path == "" {
+		return nil, errors.New("No path specified for file relay")
+	}
+	encode := fileEncoders[opt.Encoding]
+	if encode == nil {
+		names := []string{}
+		for name := range fileEncoders {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("Unknown file relay encoding %v. Expected one of %v", opt.Encoding, strings.Join(names, ", "))
+	}
+	if opt.MaxSizeMB <= 0 {
+		return nil, fmt.Errorf("Invalid maxSizeMB %v for file relay", opt.MaxSizeMB)
+	}
+	if opt.RotateEvery != "" && opt.RotateEvery != fileRotateHour && opt.RotateEvery != fileRotateDay {
+		return nil, fmt.Errorf("Unknown rotateEvery %v for file relay. Expected %v or %v", opt.RotateEvery, fileRotateHour, fileRotateDay)
+	}
+	// lumberjack only opens the file on the first write, so we don't touch the file system here
+	return &FileRelay{
+		s:           s,
+		Path:        opt.Path,
+		Encoding:    opt.Encoding,
+		RotateEvery: opt.RotateEvery,
+		LocalTime:   opt.LocalTime,
+		encode:      encode,
+		out: &lumberjack.Logger{
+			Filename:   opt.Path,
+			MaxSize:    opt.MaxSizeMB,
+			MaxBackups: opt.MaxBackups,
+			MaxAge:     opt.MaxAgeDays,
+			Compress:   opt.Compress,
+			LocalTime:  opt.LocalTime,
+		},
+	}, nil
+}
+
+func (fr *FileRelay) Send(messages []*LogMsg) error {
+	fr.lock.Lock()
+	defer fr.lock.Unlock()
+	if err := fr.rotateIfDue(); err != nil {
+		fr.s.logMetaf("Unable to rotate %v: %v", fr.Path, err)
+		return err
+	}
+	maxLine := fr.out.MaxSize * 1024 * 1024
+	buf := &bytes.Buffer{}
+	for _, m := range messages {
+		line, err := fr.encode(m)
+		if err != nil {
+			fr.s.logMetaf("Unable to encode message for %v: %v", fr.Path, err)
+			continue
+		}
+		// lumberjack refuses writes that are larger than a whole file
+		if len(line)+1 > maxLine {
+			fr.s.logMetaf("Dropped a message of %v bytes, which is larger than the maximum size of %v", len(line), fr.Path)
+			continue
+		}
+		if buf.Len() != 0 && buf.Len()+len(line)+1 > fileRelayWriteChunk {
+			if err := fr.write(buf); err != nil {
+				return err
+			}
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	return fr.write(buf)
+}
+
+func (fr *FileRelay) write(buf *bytes.Buffer) error {
+	if buf.Len() == 0 {
+		return nil
+	}
+	_, err := fr.out.Write(buf.Bytes())
+	buf.Reset()
+	if err != nil {
+		fr.s.logMetaf("Error writing to %v: %v", fr.Path, err)
+	}
+	return err
+}
+
+// Rotate the file if the hour or day has changed since it was started. The first time we're
+// called, we look at when the existing file was last written, so that a file from before a
+// restart is rotated too.
+func (fr *FileRelay) rotateIfDue() error {
+	if fr.RotateEvery == "" {
+		return nil
+	}
+	now := fr.periodOf(time.Now())
+	if fr.period == "" {
+		fr.period = now
+		if st, err := os.Stat(fr.Path); err == nil && st.Size() != 0 {
+			fr.period = fr.periodOf(st.ModTime())
+		}
+	}
+	if fr.period == now {
+		return nil
+	}
+	fr.period = now
+	if _, err := os.Stat(fr.Path); os.IsNotExist(err) {
+		return nil
+	}
+	return fr.out.Rotate()
+}
+
+func (fr *FileRelay) periodOf(t time.Time) string {
+	if !fr.LocalTime {
+		t = t.UTC()
+	}
+	if fr.RotateEvery == fileRotateHour {
+		return t.Format("2006-01-02T15")
+	}
+	return t.Format("2006-01-02")
+}
+
+func encodeFileJson(m *LogMsg) ([]byte, error) {
+	traceID, spanID := m.TraceContext()
+	return json.Marshal(&fileJsonRecord{
+		Time:             m.Time.Format(time.RFC3339Nano),
+		Level:            m.Level().String(),
+		Severity:         string(m.Severity),
+		Host:             string(m.Host),
+		OwnHostname:      string(m.OwnHostname),
+		Source:           string(m.Source),
+		Format:           string(m.Format),
+		Message:          string(m.Message),
+		ProcessID:        string(m.ProcessID),
+		ThreadID:         string(m.ThreadID),
+		ClientIP:         string(m.ClientIP),
+		Request:          string(m.Request),
+		ResponseCode:     string(m.ResponseCode),
+		ResponseBytes:    string(m.ResponseBytes),
+		ResponseDuration: string(m.ResponseDuration),
+		JavaClass:        string(m.JavaClass),
+		TraceID:          string(traceID),
+		SpanID:           string(spanID),
+		Truncated:        m.Truncated,
+	})
+}
+
+func (fr *FileRelay) Close() error {
+	fr.lock.Lock()
+	defer fr.lock.Unlock()
+	return fr.out.Close()
+}
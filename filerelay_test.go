@@ -0,0 +1,129 @@
+package logscraper
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Scrape a log through a file relay, as a parser's end to end test would
+func TestFileRelayEndToEnd(t *testing.T) {
+	cases := []struct {
+		name    string
+		parser  string
+		log     string
+		records []fileJsonRecord
+	}{
+		{
+			name:   "go",
+			parser: "go",
+			log: "2020-01-01T10:00:00.000000Z [I] Starting\n" +
+				"2020-01-01T10:00:01.500000Z [E] Failed trace_id=0af7651916cd43dd8448eb211c80319c span_id=b7ad6b7169203331\n" +
+				"\tat the second line\n" +
+				"2020-01-01T10:00:02.000000Z [I] Done\n",
+			records: []fileJsonRecord{
+				{Time: "2020-01-01T10:00:00Z", Level: "info", Severity: "I", Host: "host", OwnHostname: "ownhost", Source: "app", Format: "go", Message: "Starting"},
+				{
+					Time: "2020-01-01T10:00:01.5Z", Level: "error", Severity: "E", Host: "host", OwnHostname: "ownhost", Source: "app", Format: "go",
+					Message: "Failed trace_id=0af7651916cd43dd8448eb211c80319c span_id=b7ad6b7169203331\n\tat the second line",
+					TraceID: "0af7651916cd43dd8448eb211c80319c", SpanID: "b7ad6b7169203331",
+				},
+				{Time: "2020-01-01T10:00:02Z", Level: "info", Severity: "I", Host: "host", OwnHostname: "ownhost", Source: "app", Format: "go", Message: "Done"},
+			},
+		},
+		{
+			name:   "albion",
+			parser: "albion",
+			log:    "2020-01-01T10:00:00.000000Z [W] 0000abcd Low on disk\n",
+			records: []fileJsonRecord{
+				{Time: "2020-01-01T10:00:00Z", Level: "warning", Severity: "W", Host: "host", OwnHostname: "ownhost", Source: "app", Format: "albion", Message: "Low on disk", ProcessID: "0000abcd"},
+			},
+		},
+	}
+	defer setRelayers(currentRelayers())
+	for _, c := range cases {
+		dir := t.TempDir()
+		logFile := filepath.Join(dir, "app.log")
+		if err := ioutil.WriteFile(logFile, []byte(c.log), 0644); err != nil {
+			t.Fatal(err)
+		}
+		outFile := filepath.Join(dir, "out", "relay.log")
+		s := NewScraper("host", "ownhost", "", "")
+		relay := newTestRelay(t, s, `{"name": "file", "type": "file", "path": `+jsonString(outFile)+`}`)
+		setRelayers(map[string]Relay{"file": relay})
+
+		file, err := os.Open(logFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		src := NewLogSource("app", logFile, parsersByName[c.parser])
+		src.ParserName = c.parser
+		s.scan(file, src, 0)
+		file.Close()
+		closeRelay(relay)
+
+		records := readFileRelayRecords(t, outFile)
+		if !reflect.DeepEqual(records, c.records) {
+			t.Errorf("%v: wrote\n%+v\nexpected\n%+v", c.name, records, c.records)
+		}
+	}
+}
+
+// Every encoding writes one line per message, even for a message of several lines
+func TestFileRelayEncodings(t *testing.T) {
+	messages := []*LogMsg{
+		{Source: []byte("app"), Severity: []byte("E"), Message: []byte("first\nsecond")},
+		{Source: []byte("app"), Severity: []byte("I"), Message: []byte("third")},
+	}
+	for name := range fileEncoders {
+		outFile := filepath.Join(t.TempDir(), "relay.log")
+		s := NewScraper("host", "ownhost", "", "")
+		relay := newTestRelay(t, s, `{"name": "file", "type": "file", "encoding": "`+name+`", "path": `+jsonString(outFile)+`}`)
+		if err := relay.Send(messages); err != nil {
+			t.Errorf("%v: %v", name, err)
+		}
+		closeRelay(relay)
+		raw, err := ioutil.ReadFile(outFile)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		lines := strings.Split(strings.TrimSuffix(string(raw), "\n"), "\n")
+		if len(lines) != len(messages) {
+			t.Errorf("%v: wrote %v lines, expected %v:\n%s", name, len(lines), len(messages), raw)
+			continue
+		}
+		for _, line := range lines {
+			if name != "syslog" && !json.Valid([]byte(line)) {
+				t.Errorf("%v: wrote a line that isn't JSON: %v", name, line)
+			}
+		}
+	}
+}
+
+func readFileRelayRecords(t *testing.T, filename string) []fileJsonRecord {
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var records []fileJsonRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var r fileJsonRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("Invalid line %q: %v", scanner.Text(), err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func jsonString(s string) string {
+	raw, _ := json.Marshal(s)
+	return string(raw)
+}
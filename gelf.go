@@ -0,0 +1,342 @@
+package logscraper
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+GelfRelay sends messages to Graylog (or anything else that speaks GELF 1.1), over one of:
+
+	udp   Each message in its own datagram, compressed, and split into chunks if it doesn't fit
+	tcp   Uncompressed, with each message terminated by a null byte. The connection is kept open.
+	http  Each message in its own POST to /gelf, optionally compressed
+
+The first line of a message is its short_message, and if there is more to it (eg a stack trace),
+then the whole message is its full_message. The level is the syslog severity of the message's
+Level, and the other fields of the message become additional fields, such as _java_class.
+*/
+
+const (
+	gelfTransportUDP     = "udp"
+	gelfTransportTCP     = "tcp"
+	gelfTransportHTTP    = "http"
+	gelfCompressGzip     = "gzip"
+	gelfCompressZlib     = "zlib"
+	gelfCompressNone     = "none"
+	gelfDefaultChunkSize = 1420 // Fits in an ethernet frame, with room for the IP and UDP headers
+	gelfMaxChunks        = 128
+	gelfChunkHeaderSize  = 12
+	gelfDialTimeout      = 10 * time.Second
+	gelfWriteTimeout     = 30 * time.Second
+	gelfHTTPTimeout      = 30 * time.Second
+)
+
+type GelfRelay struct {
+	s           *Scraper
+	Transport   string
+	Address     string       // host:port, for udp and tcp
+	URL         string       // For http
+	Compression string       // For udp and http
+	ChunkSize   int          // For udp
+	TLS         bool         // For tcp
+	client      *http.Client // For http
+	lock        sync.Mutex
+	conn        net.Conn
+}
+
+type gelfMessage struct {
+	Version          string  `json:"version"`
+	Host             string  `json:"host"`
+	ShortMessage     string  `json:"short_message"`
+	FullMessage      string  `json:"full_message,omitempty"`
+	Timestamp        float64 `json:"timestamp"`
+	Level            int     `json:"level"`
+	Source           string  `json:"_source,omitempty"`
+	Format           string  `json:"_format,omitempty"`
+	Severity         string  `json:"_severity,omitempty"`
+	OwnHostname      string  `json:"_ownhostname,omitempty"`
+	ProcessID        string  `json:"_process_id,omitempty"`
+	ThreadID         string  `json:"_thread_id,omitempty"`
+	ClientIP         string  `json:"_client_ip,omitempty"`
+	Request          string  `json:"_request,omitempty"`
+	ResponseCode     string  `json:"_response_code,omitempty"`
+	ResponseBytes    string  `json:"_response_bytes,omitempty"`
+	ResponseDuration string  `json:"_response_duration,omitempty"`
+	JavaClass        string  `json:"_java_class,omitempty"`
+	Truncated        bool    `json:"_truncated,omitempty"`
+}
+
+func newGelfRelay(s *Scraper, cfg *RelayConfig) (Relay, error) {
+	opt := struct {
+		Transport      string `json:"transport"`
+		Address        string `json:"address"`
+		URL            string `json:"url"`
+		Compression    string `json:"compression"`
+		ChunkSize      int    `json:"chunkSize"`
+		TLS            bool   `json:"tls"`
+		TimeoutSeconds int    `json:"timeoutSeconds"` // For http
+	}{
+		Transport:      gelfTransportUDP,
+		Compression:    gelfCompressGzip,
+		ChunkSize:      gelfDefaultChunkSize,
+		TimeoutSeconds: int(gelfHTTPTimeout / time.Second),
+	}
+	if err := cfg.Decode(&opt); err != nil {
+		return nil, err
+	}
+	switch opt.Transport {
+	case gelfTransportUDP, gelfTransportTCP:
+		if _, _, err := net.SplitHostPort(opt.Address); err != nil {
+			return nil, fmt.Errorf("Invalid GELF address %v: %v", opt.Address, err)
+		}
+	case gelfTransportHTTP:
+		if opt.URL == "" {
+			return nil, errors.New("No GELF URL specified")
+		}
+		if !strings.HasSuffix(opt.URL, "/gelf") {
+			opt.URL = strings.TrimRight(opt.URL, "/") + "/gelf"
+		}
+	default:
+		return nil, fmt.Errorf("Unknown GELF transport %v. Expected udp, tcp or http", opt.Transport)
+	}
+	switch opt.Compression {
+	case gelfCompressGzip, gelfCompressZlib, gelfCompressNone:
+	default:
+		return nil, fmt.Errorf("Unknown GELF compression %v. Expected gzip, zlib or none", opt.Compression)
+	}
+	if opt.Transport == gelfTransportHTTP && opt.Compression == gelfCompressZlib {
+		return nil, errors.New("GELF over HTTP only supports gzip compression")
+	}
+	if opt.ChunkSize <= gelfChunkHeaderSize {
+		return nil, fmt.Errorf("GELF chunk size %v is too small", opt.ChunkSize)
+	}
+	if opt.TimeoutSeconds <= 0 {
+		return nil, fmt.Errorf("Invalid GELF timeoutSeconds %v", opt.TimeoutSeconds)
+	}
+	return &GelfRelay{
+		s:           s,
+		Transport:   opt.Transport,
+		Address:     opt.Address,
+		URL:         opt.URL,
+		Compression: opt.Compression,
+		ChunkSize:   opt.ChunkSize,
+		TLS:         opt.TLS,
+		client:      &http.Client{Timeout: time.Duration(opt.TimeoutSeconds) * time.Second},
+	}, nil
+}
+
+func (gr *GelfRelay) Send(messages []*LogMsg) error {
+	gr.lock.Lock()
+	defer gr.lock.Unlock()
+	for i, m := range messages {
+		raw, err := json.Marshal(gelfFromLogMsg(m))
+		if err != nil {
+			gr.s.logMetaf("Unable to encode message for GELF: %v", err)
+			continue
+		}
+		switch gr.Transport {
+		case gelfTransportUDP:
+			err = gr.sendUDP(raw)
+		case gelfTransportTCP:
+			err = gr.sendTCP(raw)
+		case gelfTransportHTTP:
+			err = gr.sendHTTP(raw)
+		}
+		// Sending a message that failed on its own again won't help, so we drop it
+		if _, ok := err.(gelfMessageError); ok {
+			gr.s.logMetaf("%v", err)
+		} else if isPermanent(err) {
+			gr.s.logMetaf("Dropped GELF message that was rejected: %v", err)
+		} else if err != nil {
+			// The connection is broken, so the rest would fail too. The messages before this one
+			// have been delivered, so only this one and the rest are sent again.
+			gr.s.logMetaf("Error sending GELF to %v: %v", gr.Transport, err)
+			return partialError{err, i}
+		}
+	}
+	return nil
+}
+
+// An error that affects only a single message, which we drop before carrying on with the rest
+type gelfMessageError struct {
+	error
+}
+
+func gelfFromLogMsg(m *LogMsg) *gelfMessage {
+	msg := strings.TrimRight(string(m.Message), "\r\n")
+	short := msg
+	full := ""
+	if i := strings.IndexAny(msg, "\r\n"); i >= 0 {
+		short = msg[:i]
+		full = msg
+	}
+	if short == "" {
+		short = "-" // GELF requires a short_message
+	}
+	host := string(m.Host)
+	if host == "" {
+		host = string(m.OwnHostname)
+	}
+	return &gelfMessage{
+		Version:          "1.1",
+		Host:             host,
+		ShortMessage:     short,
+		FullMessage:      full,
+		Timestamp:        float64(m.Time.UnixNano()/1e6) / 1e3,
+		Level:            m.Level().Syslog(),
+		Source:           string(m.Source),
+		Format:           string(m.Format),
+		Severity:         string(m.Severity),
+		OwnHostname:      string(m.OwnHostname),
+		ProcessID:        string(m.ProcessID),
+		ThreadID:         string(m.ThreadID),
+		ClientIP:         string(m.ClientIP),
+		Request:          string(m.Request),
+		ResponseCode:     string(m.ResponseCode),
+		ResponseBytes:    string(m.ResponseBytes),
+		ResponseDuration: string(m.ResponseDuration),
+		JavaClass:        string(m.JavaClass),
+		Truncated:        m.Truncated,
+	}
+}
+
+func (gr *GelfRelay) compress(raw []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch gr.Compression {
+	case gelfCompressGzip:
+		w = gzip.NewWriter(&buf)
+	case gelfCompressZlib:
+		w = zlib.NewWriter(&buf)
+	default:
+		return raw, nil
+	}
+	w.Write(raw)
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gr *GelfRelay) sendUDP(raw []byte) error {
+	payload, err := gr.compress(raw)
+	if err != nil {
+		return gelfMessageError{err}
+	}
+	if gr.conn == nil {
+		conn, err := net.DialTimeout("udp", gr.Address, gelfDialTimeout)
+		if err != nil {
+			return err
+		}
+		gr.conn = conn
+	}
+	if len(payload) <= gr.ChunkSize {
+		_, err = gr.conn.Write(payload)
+		return err
+	}
+
+	dataSize := gr.ChunkSize - gelfChunkHeaderSize
+	count := (len(payload) + dataSize - 1) / dataSize
+	if count > gelfMaxChunks {
+		return gelfMessageError{fmt.Errorf("Dropped GELF message of %v bytes, which needs more than %v chunks", len(payload), gelfMaxChunks)}
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return gelfMessageError{err}
+	}
+	chunk := make([]byte, 0, gr.ChunkSize)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * dataSize
+		if end > len(payload) {
+			end = len(payload)
+		}
+		chunk = append(chunk[:0], 0x1e, 0x0f)
+		chunk = append(chunk, id...)
+		chunk = append(chunk, byte(i), byte(count))
+		chunk = append(chunk, payload[i*dataSize:end]...)
+		if _, err := gr.conn.Write(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (gr *GelfRelay) sendTCP(raw []byte) error {
+	frame := append(raw, 0)
+	// If the connection was dropped since the last message, then we only find out when we write
+	// to it, so we reconnect once and try again.
+	for attempt := 0; ; attempt++ {
+		if gr.conn == nil {
+			conn, err := gr.dialTCP()
+			if err != nil {
+				return err
+			}
+			gr.conn = conn
+		}
+		gr.conn.SetWriteDeadline(time.Now().Add(gelfWriteTimeout))
+		_, err := gr.conn.Write(frame)
+		if err == nil {
+			return nil
+		}
+		gr.conn.Close()
+		gr.conn = nil
+		if attempt == 1 {
+			return err
+		}
+	}
+}
+
+func (gr *GelfRelay) dialTCP() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: gelfDialTimeout}
+	if gr.TLS {
+		return tls.DialWithDialer(dialer, "tcp", gr.Address, nil)
+	}
+	return dialer.Dial("tcp", gr.Address)
+}
+
+func (gr *GelfRelay) sendHTTP(raw []byte) error {
+	payload, err := gr.compress(raw)
+	if err != nil {
+		return gelfMessageError{err}
+	}
+	req, err := http.NewRequest("POST", gr.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if gr.Compression == gelfCompressGzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	resp, err := gr.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return checkResponse(resp)
+}
+
+func (gr *GelfRelay) Close() error {
+	gr.lock.Lock()
+	defer gr.lock.Unlock()
+	if gr.conn == nil {
+		return nil
+	}
+	err := gr.conn.Close()
+	gr.conn = nil
+	return err
+}
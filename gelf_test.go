@@ -0,0 +1,81 @@
+package logscraper
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGelfSendHTTP(t *testing.T) {
+	cases := []struct {
+		name     string
+		statuses map[string]int // Response to the message with this short_message. 202 otherwise.
+		posted   []string
+		sent     int // Messages accepted, if we expect a partialError
+		fail     bool
+	}{
+		{name: "all accepted", posted: []string{"one", "two", "three"}},
+		{name: "one rejected", statuses: map[string]int{"two": 400}, posted: []string{"one", "two", "three"}},
+		{name: "server error", statuses: map[string]int{"two": 500}, posted: []string{"one", "two"}, sent: 1, fail: true},
+	}
+	for _, c := range cases {
+		var posted []string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			raw, _ := ioutil.ReadAll(r.Body)
+			var msg gelfMessage
+			json.Unmarshal(raw, &msg)
+			posted = append(posted, msg.ShortMessage)
+			if status, ok := c.statuses[msg.ShortMessage]; ok {
+				w.WriteHeader(status)
+			} else {
+				w.WriteHeader(http.StatusAccepted)
+			}
+		}))
+		s := NewScraper("host", "ownhost", "", "")
+		relay := newTestRelay(t, s, `{"name": "gelf", "type": "gelf", "transport": "http", "compression": "none", "url": "`+server.URL+`"}`)
+		err := relay.Send([]*LogMsg{{Message: []byte("one")}, {Message: []byte("two")}, {Message: []byte("three")}})
+		server.Close()
+
+		if strings.Join(posted, ",") != strings.Join(c.posted, ",") {
+			t.Errorf("%v: posted %v, expected %v", c.name, posted, c.posted)
+		}
+		var partial partialError
+		if !c.fail {
+			if err != nil {
+				t.Errorf("%v: %v", c.name, err)
+			}
+		} else if !errors.As(err, &partial) || partial.Sent != c.sent {
+			t.Errorf("%v: returned %#v, expected a partialError after %v messages", c.name, err, c.sent)
+		}
+	}
+}
+
+// A message that is too big to send is dropped, rather than failing the ones after it
+func TestGelfSendUDPTooLarge(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	s := NewScraper("host", "ownhost", "", "")
+	relay := newTestRelay(t, s, `{"name": "gelf", "type": "gelf", "compression": "none", "chunkSize": 100, "address": "`+conn.LocalAddr().String()+`"}`)
+	defer closeRelay(relay)
+	huge := strings.Repeat("x", 100*gelfMaxChunks)
+	if err := relay.Send([]*LogMsg{{Message: []byte(huge)}, {Message: []byte("small")}}); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	buf := make([]byte, 1000)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg gelfMessage
+	if err := json.Unmarshal(buf[:n], &msg); err != nil || msg.ShortMessage != "small" {
+		t.Errorf("Received %q, expected the small message", buf[:n])
+	}
+}
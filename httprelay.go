@@ -0,0 +1,361 @@
+package logscraper
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+)
+
+/*
+HttpRelay sends messages to any HTTP endpoint, such as a Slack or Teams incoming webhook, or an
+internal ticketing system, without needing a relay of its own. The request body is rendered from
+a Go text/template, either once per message (mode "message"), with a httpRelayMessage as its data,
+or once per batch of up to batchSize messages (mode "batch"), with a httpRelayBatch. For example,
+a Slack webhook that is told about errors:
+
+	{"name": "slack", "type": "http", "url": "https://hooks.slack.com/services/...",
+	 "mode": "message", "minLevel": "error",
+	 "body": "{\"text\": {{json (printf \"%s on %s: %s\" .Source .Host (truncate .Message 1000))}}}"}
+
+Besides the standard template functions, there are json (which encodes a value as JSON, so that
+strings are quoted and escaped), truncate, lower and upper. Without a template, the body is our
+normalized JSON form of the message (see FileRelay), or a JSON array of them for a batch.
+
+auth may be one of:
+
+	{"type": "basic", "username": "...", "password": "..."}
+	{"type": "bearer", "token": "..."}
+	{"type": "apiKey", "name": "X-Api-Key", "value": "...", "in": "header"}  (or "in": "query")
+*/
+
+const (
+	httpRelayModeMessage = "message"
+	httpRelayModeBatch   = "batch"
+	httpRelayTimeout     = 30 * time.Second
+)
+
+type HttpRelay struct {
+	s           *Scraper
+	Method      string
+	URL         string
+	Headers     map[string]string
+	ContentType string
+	Auth        httpRelayAuth
+	Mode        string // httpRelayModeMessage or httpRelayModeBatch
+	BatchSize   int
+	MinLevel    Level // Messages below this level are not sent. LevelUnknown sends everything.
+	body        *template.Template
+	client      *http.Client
+}
+
+type httpRelayAuth struct {
+	Type     string `json:"type"` // basic, bearer or apiKey
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Token    string `json:"token"`
+	Name     string `json:"name"` // The header or query parameter that holds an API key
+	Value    string `json:"value"`
+	In       string `json:"in"` // header or query
+}
+
+// The data of a body template in message mode
+type httpRelayMessage struct {
+	Time             time.Time
+	Level            string
+	Severity         string
+	Host             string
+	OwnHostname      string
+	Source           string
+	Format           string
+	Message          string
+	ProcessID        string
+	ThreadID         string
+	ClientIP         string
+	Request          string
+	ResponseCode     string
+	ResponseBytes    string
+	ResponseDuration string
+	JavaClass        string
+	TraceID          string
+	SpanID           string
+	Truncated        bool
+}
+
+// The data of a body template in batch mode
+type httpRelayBatch struct {
+	Messages []*httpRelayMessage
+	Count    int
+}
+
+var httpRelayTemplateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		raw, err := json.Marshal(v)
+		return string(raw), err
+	},
+	"truncate": truncateString,
+	"lower":    strings.ToLower,
+	"upper":    strings.ToUpper,
+}
+
+func newHttpRelay(s *Scraper, cfg *RelayConfig) (Relay, error) {
+	opt := struct {
+		Method             string            `json:"method"`
+		URL                string            `json:"url"`
+		Headers            map[string]string `json:"headers"`
+		ContentType        string            `json:"contentType"`
+		Auth               httpRelayAuth     `json:"auth"`
+		Mode               string            `json:"mode"`
+		BatchSize          int               `json:"batchSize"`
+		MinLevel           string            `json:"minLevel"`
+		Body               string            `json:"body"`     // A template
+		BodyFile           string            `json:"bodyFile"` // A file that holds the template, instead of body
+		TimeoutSeconds     int               `json:"timeoutSeconds"`
+		InsecureSkipVerify bool              `json:"insecureSkipVerify"`
+	}{
+		Method:         "POST",
+		ContentType:    "application/json",
+		Mode:           httpRelayModeBatch,
+		BatchSize:      100,
+		TimeoutSeconds: int(httpRelayTimeout / time.Second),
+	}
+	if err := cfg.Decode(&opt); err != nil {
+		return nil, err
+	}
+	if opt.URL == "" {
+		return nil, errors.New("No URL specified for HTTP relay")
+	}
+	if u, err := url.Parse(opt.URL); err != nil || u.Host == "" {
+		return nil, fmt.Errorf("Invalid HTTP relay URL %v", opt.URL)
+	}
+	if opt.Mode != httpRelayModeMessage && opt.Mode != httpRelayModeBatch {
+		return nil, fmt.Errorf("Unknown HTTP relay mode %v. Expected %v or %v", opt.Mode, httpRelayModeMessage, httpRelayModeBatch)
+	}
+	if opt.BatchSize <= 0 {
+		return nil, fmt.Errorf("Invalid HTTP relay batchSize %v", opt.BatchSize)
+	}
+	if err := opt.Auth.check(); err != nil {
+		return nil, err
+	}
+	hr := &HttpRelay{
+		s:           s,
+		Method:      strings.ToUpper(opt.Method),
+		URL:         opt.URL,
+		Headers:     opt.Headers,
+		ContentType: opt.ContentType,
+		Auth:        opt.Auth,
+		Mode:        opt.Mode,
+		BatchSize:   opt.BatchSize,
+	}
+	if opt.MinLevel != "" {
+		if hr.MinLevel = ParseLevel([]byte(opt.MinLevel)); hr.MinLevel == LevelUnknown {
+			return nil, fmt.Errorf("Unknown HTTP relay minLevel %v", opt.MinLevel)
+		}
+	}
+
+	if opt.BodyFile != "" {
+		if opt.Body != "" {
+			return nil, errors.New("HTTP relay may have a body or a bodyFile, but not both")
+		}
+		raw, err := ioutil.ReadFile(opt.BodyFile)
+		if err != nil {
+			return nil, err
+		}
+		opt.Body = string(raw)
+	}
+	if opt.Body != "" {
+		body, err := template.New(cfg.Name).Funcs(httpRelayTemplateFuncs).Option("missingkey=error").Parse(opt.Body)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid HTTP relay body template: %v", err)
+		}
+		hr.body = body
+		// Catch references to fields that don't exist now, rather than when we drop messages
+		if _, err := hr.render([]*LogMsg{{}}); err != nil {
+			return nil, fmt.Errorf("Invalid HTTP relay body template: %v", err)
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if opt.InsecureSkipVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	hr.client = &http.Client{Transport: transport, Timeout: time.Duration(opt.TimeoutSeconds) * time.Second}
+	return hr, nil
+}
+
+func (a *httpRelayAuth) check() error {
+	switch a.Type {
+	case "":
+	case "basic":
+		if a.Username == "" {
+			return errors.New("No username specified for basic auth")
+		}
+	case "bearer":
+		if a.Token == "" {
+			return errors.New("No token specified for bearer auth")
+		}
+	case "apiKey":
+		if a.Name == "" || a.Value == "" {
+			return errors.New("An API key needs a name and a value")
+		}
+		if a.In == "" {
+			a.In = "header"
+		}
+		if a.In != "header" && a.In != "query" {
+			return fmt.Errorf("Unknown API key location %v. Expected header or query", a.In)
+		}
+	default:
+		return fmt.Errorf("Unknown auth type %v. Expected basic, bearer or apiKey", a.Type)
+	}
+	return nil
+}
+
+func (hr *HttpRelay) Send(messages []*LogMsg) error {
+	var selected []*LogMsg
+	var index []int // Of each selected message in messages
+	for i, m := range messages {
+		if hr.MinLevel == LevelUnknown || m.Level() >= hr.MinLevel {
+			selected = append(selected, m)
+			index = append(index, i)
+		}
+	}
+	size := hr.BatchSize
+	if hr.Mode == httpRelayModeMessage {
+		size = 1
+	}
+	for start := 0; start < len(selected); start += size {
+		end := start + size
+		if end > len(selected) {
+			end = len(selected)
+		}
+		err := hr.send(selected[start:end])
+		if isPermanent(err) {
+			// eg the endpoint doesn't like the body that our template rendered, which it never will
+			hr.s.logMetaf("Dropped %v messages that the HTTP relay rejected", end-start)
+		} else if err != nil {
+			// The requests before this one were accepted, so only this one and the rest are sent again
+			return partialError{err, index[start]}
+		}
+	}
+	return nil
+}
+
+// Send a single request, for one message in message mode, or for a batch
+func (hr *HttpRelay) send(messages []*LogMsg) error {
+	body, err := hr.render(messages)
+	if err != nil {
+		// The template can't be fixed by trying again, so we drop what it can't render
+		hr.s.logMetaf("Unable to render body of HTTP relay for %v messages: %v", len(messages), err)
+		return nil
+	}
+	req, err := http.NewRequest(hr.Method, hr.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", hr.ContentType)
+	for name, value := range hr.Headers {
+		req.Header.Set(name, value)
+	}
+	switch hr.Auth.Type {
+	case "basic":
+		req.SetBasicAuth(hr.Auth.Username, hr.Auth.Password)
+	case "bearer":
+		req.Header.Set("Authorization", "Bearer "+hr.Auth.Token)
+	case "apiKey":
+		if hr.Auth.In == "query" {
+			q := req.URL.Query()
+			q.Set(hr.Auth.Name, hr.Auth.Value)
+			req.URL.RawQuery = q.Encode()
+		} else {
+			req.Header.Set(hr.Auth.Name, hr.Auth.Value)
+		}
+	}
+	resp, err := hr.client.Do(req)
+	if err != nil {
+		// Leave out the URL, which may hold an API key
+		if ue, ok := err.(*url.Error); ok {
+			err = ue.Err
+		}
+		hr.s.logMetaf("Error sending to HTTP relay %v: %v", req.URL.Host, err)
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		reason, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 500))
+		hr.s.logMetaf("HTTP relay request failed: %v: %s", err, bytes.TrimSpace(reason))
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
+
+func (hr *HttpRelay) render(messages []*LogMsg) ([]byte, error) {
+	if hr.body == nil {
+		if hr.Mode == httpRelayModeMessage {
+			return encodeFileJson(messages[0])
+		}
+		var buf bytes.Buffer
+		buf.WriteByte('[')
+		for i, m := range messages {
+			raw, err := encodeFileJson(m)
+			if err != nil {
+				return nil, err
+			}
+			if i != 0 {
+				buf.WriteByte(',')
+			}
+			buf.Write(raw)
+		}
+		buf.WriteByte(']')
+		return buf.Bytes(), nil
+	}
+
+	var data interface{}
+	if hr.Mode == httpRelayModeMessage {
+		data = newHttpRelayMessage(messages[0])
+	} else {
+		batch := &httpRelayBatch{Count: len(messages)}
+		for _, m := range messages {
+			batch.Messages = append(batch.Messages, newHttpRelayMessage(m))
+		}
+		data = batch
+	}
+	var buf bytes.Buffer
+	if err := hr.body.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func newHttpRelayMessage(m *LogMsg) *httpRelayMessage {
+	traceID, spanID := m.TraceContext()
+	return &httpRelayMessage{
+		Time:             m.Time,
+		Level:            m.Level().String(),
+		Severity:         string(m.Severity),
+		Host:             string(m.Host),
+		OwnHostname:      string(m.OwnHostname),
+		Source:           string(m.Source),
+		Format:           string(m.Format),
+		Message:          string(m.Message),
+		ProcessID:        string(m.ProcessID),
+		ThreadID:         string(m.ThreadID),
+		ClientIP:         string(m.ClientIP),
+		Request:          string(m.Request),
+		ResponseCode:     string(m.ResponseCode),
+		ResponseBytes:    string(m.ResponseBytes),
+		ResponseDuration: string(m.ResponseDuration),
+		JavaClass:        string(m.JavaClass),
+		TraceID:          string(traceID),
+		SpanID:           string(spanID),
+		Truncated:        m.Truncated,
+	}
+}
@@ -0,0 +1,95 @@
+package logscraper
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHttpRelaySend(t *testing.T) {
+	cases := []struct {
+		name     string
+		def      string         // Settings, besides the name, type and url
+		statuses map[string]int // Response to the request whose body is the key. 200 otherwise.
+		posted   []string
+		sent     int // Messages accepted, if we expect a partialError
+		fail     bool
+	}{
+		{
+			name:   "messages",
+			def:    `"mode": "message", "body": "{{.Message}}"`,
+			posted: []string{"one", "two", "three", "four", "five"},
+		},
+		{
+			name:     "message rejected",
+			def:      `"mode": "message", "body": "{{.Message}}"`,
+			statuses: map[string]int{"two": 400},
+			posted:   []string{"one", "two", "three", "four", "five"},
+		},
+		{
+			name:     "message failed",
+			def:      `"mode": "message", "body": "{{.Message}}"`,
+			statuses: map[string]int{"three": 502},
+			posted:   []string{"one", "two", "three"},
+			sent:     2,
+			fail:     true,
+		},
+		{
+			name:     "message failed, with some not selected",
+			def:      `"mode": "message", "minLevel": "error", "body": "{{.Message}}"`,
+			statuses: map[string]int{"four": 502},
+			posted:   []string{"two", "four"},
+			sent:     3,
+			fail:     true,
+		},
+		{
+			name:     "batch rejected",
+			def:      `"batchSize": 2, "body": "{{range .Messages}}{{.Message}}.{{end}}"`,
+			statuses: map[string]int{"one.two.": 422},
+			posted:   []string{"one.two.", "three.four.", "five."},
+		},
+		{
+			name:     "batch failed",
+			def:      `"batchSize": 2, "body": "{{range .Messages}}{{.Message}}.{{end}}"`,
+			statuses: map[string]int{"three.four.": 503},
+			posted:   []string{"one.two.", "three.four."},
+			sent:     2,
+			fail:     true,
+		},
+	}
+	for _, c := range cases {
+		var posted []string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			raw, _ := ioutil.ReadAll(r.Body)
+			posted = append(posted, string(raw))
+			if status, ok := c.statuses[string(raw)]; ok {
+				w.WriteHeader(status)
+			}
+		}))
+		s := NewScraper("host", "ownhost", "", "")
+		relay := newTestRelay(t, s, `{"name": "http", "type": "http", "url": "`+server.URL+`", `+c.def+`}`)
+		err := relay.Send([]*LogMsg{
+			{Severity: []byte("I"), Message: []byte("one")},
+			{Severity: []byte("E"), Message: []byte("two")},
+			{Severity: []byte("I"), Message: []byte("three")},
+			{Severity: []byte("E"), Message: []byte("four")},
+			{Severity: []byte("E"), Message: []byte("five")},
+		})
+		server.Close()
+
+		if strings.Join(posted, ",") != strings.Join(c.posted, ",") {
+			t.Errorf("%v: posted %v, expected %v", c.name, posted, c.posted)
+		}
+		var partial partialError
+		if !c.fail {
+			if err != nil {
+				t.Errorf("%v: %v", c.name, err)
+			}
+		} else if !errors.As(err, &partial) || partial.Sent != c.sent {
+			t.Errorf("%v: returned %#v, expected a partialError after %v messages", c.name, err, c.sent)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+// +build !windows
+
+package logscraper
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// Returns a string that uniquely identifies the file on this machine, no matter what path it
+// was opened by, or an empty string if we cannot tell.
+func fileIdentity(file *os.File) string {
+	info, err := file.Stat()
+	if err != nil {
+		return ""
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%x:%x", uint64(st.Dev), uint64(st.Ino))
+}
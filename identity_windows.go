@@ -0,0 +1,17 @@
+package logscraper
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// Returns a string that uniquely identifies the file on this machine, no matter what path it
+// was opened by, or an empty string if we cannot tell.
+func fileIdentity(file *os.File) string {
+	var info syscall.ByHandleFileInformation
+	if err := syscall.GetFileInformationByHandle(syscall.Handle(file.Fd()), &info); err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%x:%x%08x", info.VolumeSerialNumber, info.FileIndexHigh, info.FileIndexLow)
+}
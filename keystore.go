@@ -0,0 +1,188 @@
+package logscraper
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+/*
+The keystore is a file of named secrets, encrypted with AES-256-GCM under a key that belongs to
+the machine. The machine key lives in a file of its own, which is created along with the
+keystore. On Windows, the machine key is itself encrypted with DPAPI, so it is useless on any
+other machine. Elsewhere, it is only protected by its file permissions (0600), so the keystore
+keeps secrets out of config files and backups, but not away from root.
+
+Secrets are managed with the secrets command, eg
+	logscraper secrets set loggly-key < key.txt
+*/
+
+const keystoreVersion = 1
+
+type Keystore struct {
+	filename string
+	key      []byte
+	secrets  map[string]string
+}
+
+type keystoreFile struct {
+	Version int
+	Nonce   []byte
+	Data    []byte // The secrets, as encrypted JSON
+}
+
+// Open the keystore, or return an empty one if it doesn't exist yet.
+// The machine key is created if it doesn't exist yet.
+func OpenKeystore(filename, machineKeyFile string) (*Keystore, error) {
+	key, err := loadMachineKey(machineKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	ks := &Keystore{
+		filename: filename,
+		key:      key,
+		secrets:  make(map[string]string),
+	}
+
+	raw, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return ks, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var file keystoreFile
+	if err := json.Unmarshal(raw, &file); err != nil {
+		return nil, fmt.Errorf("Keystore %v is corrupt: %v", filename, err)
+	}
+	if file.Version != keystoreVersion {
+		return nil, fmt.Errorf("Keystore %v has unknown version %v", filename, file.Version)
+	}
+	gcm, err := newKeystoreCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := gcm.Open(nil, file.Nonce, file.Data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decrypt keystore %v. Was it created with a different machine key? %v", filename, err)
+	}
+	if err := json.Unmarshal(plain, &ks.secrets); err != nil {
+		return nil, fmt.Errorf("Keystore %v is corrupt: %v", filename, err)
+	}
+	return ks, nil
+}
+
+func (ks *Keystore) Get(name string) (string, bool) {
+	value, ok := ks.secrets[name]
+	return value, ok
+}
+
+func (ks *Keystore) Set(name, value string) {
+	ks.secrets[name] = value
+}
+
+func (ks *Keystore) Delete(name string) {
+	delete(ks.secrets, name)
+}
+
+func (ks *Keystore) Names() []string {
+	names := make([]string, 0, len(ks.secrets))
+	for name := range ks.secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Encrypt the secrets, and write them out
+func (ks *Keystore) Save() error {
+	plain, err := json.Marshal(ks.secrets)
+	if err != nil {
+		return err
+	}
+	gcm, err := newKeystoreCipher(ks.key)
+	if err != nil {
+		return err
+	}
+	file := keystoreFile{
+		Version: keystoreVersion,
+		Nonce:   make([]byte, gcm.NonceSize()),
+	}
+	if _, err := rand.Read(file.Nonce); err != nil {
+		return err
+	}
+	file.Data = gcm.Seal(nil, file.Nonce, plain, nil)
+	raw, err := json.Marshal(&file)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(ks.filename), 0700); err != nil {
+		return err
+	}
+	tmp := ks.filename + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ks.filename)
+}
+
+func newKeystoreCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Read the machine key, creating it if it doesn't exist yet
+func loadMachineKey(filename string) ([]byte, error) {
+	if filename == "" {
+		return nil, errors.New("No machine key file specified")
+	}
+	raw, err := os.ReadFile(filename)
+	if err == nil {
+		key, err := unprotectMachineKey(raw)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to unlock machine key %v: %v", filename, err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("Machine key %v is corrupt", filename)
+		}
+		return key, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	protected, err := protectMachineKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to protect machine key: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return nil, err
+	}
+	// O_EXCL, so that if somebody else beat us to it, we don't overwrite the key that they are using
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		return loadMachineKey(filename)
+	} else if err != nil {
+		return nil, err
+	}
+	_, err = f.Write(protected)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		os.Remove(filename)
+		return nil, err
+	}
+	return key, nil
+}
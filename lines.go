@@ -0,0 +1,134 @@
+package logscraper
+
+import (
+	"bufio"
+	"bytes"
+)
+
+// The default maximum length of a single log line. Anything longer than this is truncated.
+const defaultMaxLineSize = 1024 * 1024
+
+/*
+lineSplitter is a bufio.SplitFunc that behaves like bufio.ScanLines, except that it
+never fails with bufio.ErrTooLong. When a line exceeds maxLine, we emit the first
+maxLine bytes of it, flag it as truncated, and silently skip everything up to the
+next newline. Java stack dumps and JSON blobs regularly exceed the 64KB default of
+bufio.Scanner, and without this, such a line would wedge its source forever.
+
+Lines are split according to the newline sequence of the file's encoding, and the
+returned tokens are still in that encoding.
+
+We also keep count of the bytes that the scanner has consumed, so that the caller
+knows exactly which file positions correspond to the start and end of the last line.
+The end of a truncated line is only known once the next line is returned, since its
+tail is skipped in between.
+*/
+type lineSplitter struct {
+	maxLine   int
+	enc       *textEncoding
+	consumed  int64 // Total number of bytes that the scanner has advanced over
+	start     int64 // Offset at which the most recently returned line starts
+	skipping  bool  // True while we are discarding the tail of an over-long line
+	truncated bool  // True if the most recently returned line was cut short
+}
+
+func newLineSplitter(maxLine int, enc *textEncoding) *lineSplitter {
+	if maxLine <= 0 {
+		maxLine = defaultMaxLineSize
+	}
+	// Never cut a code unit in half
+	maxLine -= maxLine % enc.unit
+	return &lineSplitter{
+		maxLine: maxLine,
+		enc:     enc,
+	}
+}
+
+// Configure the scanner to use this splitter, with a buffer that is large enough for maxLine
+func (l *lineSplitter) attach(scanner *bufio.Scanner) {
+	initial := 64 * 1024
+	if initial > l.bufferSize() {
+		initial = l.bufferSize()
+	}
+	scanner.Buffer(make([]byte, 0, initial), l.bufferSize())
+	scanner.Split(l.split)
+}
+
+// Room for a line of maxLine, plus its line ending, so that such a line isn't truncated
+func (l *lineSplitter) bufferSize() int {
+	return l.maxLine + len(l.enc.cr) + len(l.enc.newline)
+}
+
+func (l *lineSplitter) split(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+
+	if l.skipping {
+		if i := l.indexNewline(data); i >= 0 {
+			l.skipping = false
+			return l.advance(i+len(l.enc.newline), nil)
+		}
+		return l.advance(l.wholeUnits(data, atEOF), nil)
+	}
+
+	l.truncated = false
+	l.start = l.consumed
+	if i := l.indexNewline(data); i >= 0 {
+		return l.advance(i+len(l.enc.newline), l.cut(l.dropCR(data[:i])))
+	}
+	if atEOF {
+		// Final, non-terminated line
+		return l.advance(len(data), l.cut(l.dropCR(data)))
+	}
+	if len(data) >= l.bufferSize() {
+		// The buffer is full, and still no newline
+		l.truncated = true
+		l.skipping = true
+		return l.advance(l.wholeUnits(data, atEOF), data[:l.maxLine])
+	}
+	// Request more data
+	return 0, nil, nil
+}
+
+func (l *lineSplitter) advance(n int, token []byte) (int, []byte, error) {
+	l.consumed += int64(n)
+	return n, token, nil
+}
+
+// Returns the index of the first newline in data that lies on a code unit boundary, or -1
+func (l *lineSplitter) indexNewline(data []byte) int {
+	for start := 0; start < len(data); {
+		i := bytes.Index(data[start:], l.enc.newline)
+		if i < 0 {
+			return -1
+		}
+		i += start
+		if i%l.enc.unit == 0 {
+			return i
+		}
+		start = i + 1
+	}
+	return -1
+}
+
+// Returns the length of data, rounded down to a whole number of code units, unless we're at EOF
+func (l *lineSplitter) wholeUnits(data []byte, atEOF bool) int {
+	if atEOF {
+		return len(data)
+	}
+	return len(data) - len(data)%l.enc.unit
+}
+
+// The buffer has room for a line ending, so a line that fits in it may still be a little too long
+func (l *lineSplitter) cut(line []byte) []byte {
+	if len(line) > l.maxLine {
+		l.truncated = true
+		return line[:l.maxLine]
+	}
+	return line
+}
+
+func (l *lineSplitter) dropCR(data []byte) []byte {
+	return bytes.TrimSuffix(data, l.enc.cr)
+}
@@ -0,0 +1,153 @@
+package logscraper
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// What the splitter reports for one line
+type splitLine struct {
+	text      string
+	truncated bool
+	start     int64
+	end       int64 // consumed, as it is when the line is returned
+}
+
+func splitAll(t *testing.T, input string, maxLine int) ([]splitLine, int64) {
+	scanner := bufio.NewScanner(strings.NewReader(input))
+	splitter := newLineSplitter(maxLine, encodingUTF8)
+	splitter.attach(scanner)
+	var lines []splitLine
+	for scanner.Scan() {
+		lines = append(lines, splitLine{scanner.Text(), splitter.truncated, splitter.start, splitter.consumed})
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	return lines, splitter.consumed
+}
+
+func TestLineSplitterOffsets(t *testing.T) {
+	cases := []struct {
+		name     string
+		input    string
+		maxLine  int
+		lines    []splitLine
+		consumed int64 // After the last line
+	}{
+		{
+			name:    "short lines",
+			input:   "ab\ncd\r\nef",
+			maxLine: 100,
+			lines: []splitLine{
+				{"ab", false, 0, 3},
+				{"cd", false, 3, 7},
+				{"ef", false, 7, 9},
+			},
+			consumed: 9,
+		},
+		{
+			name:    "line of exactly the maximum",
+			input:   "0123\r\nab\n",
+			maxLine: 4,
+			lines: []splitLine{
+				{"0123", false, 0, 6},
+				{"ab", false, 6, 9},
+			},
+			consumed: 9,
+		},
+		{
+			name:    "line one longer than the maximum",
+			input:   "01234\nab\n",
+			maxLine: 4,
+			lines: []splitLine{
+				{"0123", true, 0, 6},
+				{"ab", false, 6, 9},
+			},
+			consumed: 9,
+		},
+		{
+			name:    "truncated line in the middle",
+			input:   "0123456789\nab\ncd\n",
+			maxLine: 4,
+			lines: []splitLine{
+				{"0123", true, 0, 6},
+				{"ab", false, 11, 14},
+				{"cd", false, 14, 17},
+			},
+			consumed: 17,
+		},
+		{
+			name:    "consecutive truncated lines",
+			input:   "0123456789\nabcdefgh\nxy\n",
+			maxLine: 4,
+			lines: []splitLine{
+				{"0123", true, 0, 6},
+				{"abcd", true, 11, 17},
+				{"xy", false, 20, 23},
+			},
+			consumed: 23,
+		},
+		{
+			name:    "truncated line at the end, without a newline",
+			input:   "ab\n0123456789",
+			maxLine: 4,
+			lines: []splitLine{
+				{"ab", false, 0, 3},
+				{"0123", true, 3, 9},
+			},
+			consumed: 13,
+		},
+		{
+			name:    "truncated line at the end, with a newline",
+			input:   "ab\n0123456789\n",
+			maxLine: 4,
+			lines: []splitLine{
+				{"ab", false, 0, 3},
+				{"0123", true, 3, 9},
+			},
+			consumed: 14,
+		},
+	}
+	for _, c := range cases {
+		lines, consumed := splitAll(t, c.input, c.maxLine)
+		if !reflect.DeepEqual(lines, c.lines) {
+			t.Errorf("%v: got lines %+v, expected %+v", c.name, lines, c.lines)
+		}
+		if consumed != c.consumed {
+			t.Errorf("%v: consumed %v bytes, expected %v", c.name, consumed, c.consumed)
+		}
+	}
+}
+
+// A pass that runs out of budget leaves its last message for the next pass, which must then start
+// at that message, and not somewhere in the skipped tail of the truncated line before it
+func TestScanResumesAfterTruncatedLine(t *testing.T) {
+	first := "2020-01-01T00:00:00.000000Z [I] first\n"
+	long := "2020-01-01T00:00:01.000000Z [I] long " + strings.Repeat("x", 200) + "\n"
+	last := "2020-01-01T00:00:02.000000Z [I] last\n"
+	filename := filepath.Join(t.TempDir(), "test.log")
+	if err := ioutil.WriteFile(filename, []byte(first+long+last), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	s := NewScraper("host", "ownhost", "", "")
+	s.MaxLineSize = 64
+	src := NewLogSource("test", filename, parsersByName["go"])
+	if more := s.scan(file, src, int64(len(first+long+last))); !more {
+		t.Fatal("Expected the scan to stop before the last message")
+	}
+	if expected := int64(len(first + long)); src.lastPos != expected {
+		t.Errorf("Stopped at %v, expected %v", src.lastPos, expected)
+	}
+}
@@ -1,7 +1,11 @@
 /*
 LogReceivers are structs that define various log event endpoints that can
 receive IMQSV8 log events. Any new receiver can be added by extending the
-LogReceiver struct and implementing the Send(messages []*logMsg) interface method.
+LogReceiver struct and implementing the Send(messages []*logMsg) error interface method.
+Send must only return nil once the receiver has accepted the messages, because the scraper
+records the position up to which each receiver has accepted our messages. A receiver that
+can never take some messages should drop them (and say so in the meta log) rather than fail,
+or return a permanentError, so that they don't hold back everything behind them.
 
 The initial design here was to decouple the main logscraper routine from the
 actual sending of the events, as delays/issues in the sending to a receiver would
@@ -15,17 +19,48 @@ sending the events to RabbitMQ), once we have firmer requirements.
 package logscraper
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
+// receivers is replaced as a whole (never modified in place) once the scraper is running, so
+// readers only need to hold receiversLock long enough to fetch it. See currentRelayers.
 var receivers = make(map[string]Relay)
+var receiversLock sync.RWMutex
+
+// Factories for the relays that can be defined in the "relays" section of the config
+var relayFactories = map[string]func(s *Scraper, cfg *RelayConfig) (Relay, error){
+	"amqp":          newAmqpRelay,
+	"datadog":       newDatadogRelay,
+	"datadog-logs":  newDatadogLogsRelay,
+	"elasticsearch": newElasticRelay,
+	"file":          newFileRelay,
+	"gelf":          newGelfRelay,
+	"http":          newHttpRelay,
+	"loggly":        newLogglyRelay,
+	"loki":          newLokiRelay,
+	"otlp":          newOtlpRelay,
+	"splunk":        newSplunkRelay,
+	"syslog":        newSyslogRelay,
+}
+
+const datadogEventsURL = "https://app.datadoghq.com/api/v1/events"
+
+const (
+	datadogEventsTimeout = 30 * time.Second
+	logglyTimeout        = 30 * time.Second
+)
+
 var datadogSeverities = map[string]bool{
 	"ERROR": true,
 	"E":     true,
@@ -38,10 +73,38 @@ var datadogSourceExclusions = map[string]bool{
 }
 
 type Relay interface {
-	Send(messages []*LogMsg)
+	Send(messages []*LogMsg) error
 	//Receive(messages []*LogMsg)
 }
 
+// Relays that hold on to messages after Send returns (eg to batch them) must implement this,
+// so that those messages are delivered when we shut down.
+type RelayFlusher interface {
+	Flush(ctx context.Context) error
+}
+
+// An error that sending the same messages again won't fix (eg the receiver rejected them), so
+// the scraper moves past them instead of retrying. See relayMessages.
+type permanentError struct {
+	error
+}
+
+func isPermanent(err error) bool {
+	var perm permanentError
+	return errors.As(err, &perm)
+}
+
+// Returned by a relay that accepted the first Sent messages before it failed, so that only the
+// rest are sent again
+type partialError struct {
+	error
+	Sent int
+}
+
+func (e partialError) Unwrap() error {
+	return e.error
+}
+
 type LogReceiver struct {
 	s         *Scraper
 	URL       string
@@ -51,11 +114,14 @@ type LogReceiver struct {
 
 type LogglyReceiver struct {
 	LogReceiver
+	client *http.Client
 }
 
 type DatadogReceiver struct {
 	LogReceiver
-	Host string
+	Host   string
+	Tags   []string // Added to every event
+	client *http.Client
 }
 
 type logglyJsonMsg struct {
@@ -73,64 +139,88 @@ type logglyJsonMsg struct {
 	ResponseBytes    int64   `json:"response_bytes,omitempty"`
 	ResponseDuration float64 `json:"response_duration,omitempty"`
 	JavaClass        string  `json:"java_class,omitempty"`
+	Truncated        bool    `json:"truncated,omitempty"`
 }
 
 type datadogJsonMessage struct {
-	Host           string `json:"host"`
-	Title          string `json:"title"`
-	Text           string `json:"text"`
-	Time           int64  `json:"date_happened"`
-	Tags           string `json:"tags,omitempty"`
-	AlertType      string `json:"alert_type"`
-	AggregationKey string `json:"aggregation_key,omitempty"`
+	Host           string   `json:"host"`
+	Title          string   `json:"title"`
+	Text           string   `json:"text"`
+	Time           int64    `json:"date_happened"`
+	Tags           []string `json:"tags,omitempty"`
+	AlertType      string   `json:"alert_type"`
+	AggregationKey string   `json:"aggregation_key,omitempty"`
 }
 
 /*
 Encodes all messages into a single json payload to send to Loggly
 */
-func (lr *LogglyReceiver) Send(messages []*LogMsg) {
+func (lr *LogglyReceiver) Send(messages []*LogMsg) error {
 	output := &bytes.Buffer{}
 	encoder := json.NewEncoder(output)
 	for _, message := range messages {
 		message.toLogglyJson(encoder)
 	}
 
-	resp, err := http.DefaultClient.Post(lr.URL+"/"+lr.ApiKey, "application/json", bytes.NewReader(output.Bytes()))
+	resp, err := lr.client.Post(lr.URL+"/"+lr.ApiKey, "application/json", bytes.NewReader(output.Bytes()))
 	if err != nil {
 		lr.s.logMetaf("Error posting log message to %v", err)
-		return
+		return err
 	}
 	resp.Body.Close()
+	return checkResponse(resp)
 }
 
 /*
-Checks events for specific severities and sends them to Datadog individually
+Checks events for specific severities and sends them to Datadog individually. Datadog keeps the
+events that it accepted before a failure, so we only ask for the rest to be sent again, and an
+event that Datadog rejects is dropped rather than failing the events after it.
 */
-func (dr *DatadogReceiver) Send(messages []*LogMsg) {
+func (dr *DatadogReceiver) Send(messages []*LogMsg) error {
 	//Datadog can't send an array of messages, we have to send them one-by-one.
 	//This should be OK as we are only sending ERROR and FATAL messages.
-	for _, message := range messages {
+	for i, message := range messages {
 		_, severityOK := datadogSeverities[string(message.Severity)]
 		_, sourceExcl := datadogSourceExclusions[string(message.Source)]
 
 		if severityOK && !sourceExcl {
 			output := &bytes.Buffer{}
 			encoder := json.NewEncoder(output)
-			message.toDatadogJson(dr.Host, encoder)
+			message.toDatadogJson(dr.Host, dr.Tags, encoder)
 
-			resp, err := http.DefaultClient.Post(dr.URL+"?api_key="+dr.ApiKey, "application/json", bytes.NewReader(output.Bytes()))
-			if err != nil {
-				dr.s.logMetaf("Error posting log message to %v", err)
-			} else {
+			resp, err := dr.client.Post(dr.URL+"?api_key="+dr.ApiKey, "application/json", bytes.NewReader(output.Bytes()))
+			if err == nil {
 				resp.Body.Close()
+				err = checkResponse(resp)
+			}
+			if isPermanent(err) {
+				dr.s.logMetaf("Datadog rejected an event from %v: %v", string(message.Source), err)
+			} else if err != nil {
+				dr.s.logMetaf("Error posting log message to %v", err)
+				return partialError{err, i}
 			}
 		}
 	}
+	return nil
 }
 
-func (m *LogMsg) toDatadogJson(host string, target *json.Encoder) error {
+// Returns an error if the receiver did not accept our request. The error is permanent if the
+// receiver will never accept it, which is any 4xx other than a timeout or rate limit.
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err := fmt.Errorf("%v responded with %v", resp.Request.URL.Host, resp.Status)
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+			return permanentError{err}
+		}
+		return err
+	}
+	return nil
+}
+
+func (m *LogMsg) toDatadogJson(host string, tags []string, target *json.Encoder) error {
 	j := datadogJsonMessage{
 		Host:           host,
+		Tags:           tags,
 		Title:          string(m.Source),
 		Text:           string(m.Message),
 		Time:           m.Time.Unix(),
@@ -141,8 +231,8 @@ func (m *LogMsg) toDatadogJson(host string, target *json.Encoder) error {
 }
 
 func (m *LogMsg) toLogglyJson(target *json.Encoder) error {
-	pid, _ := strconv.ParseInt(string(m.ProcessID), 16, 64)
-	tid, _ := strconv.ParseInt(string(m.ThreadID), 16, 64)
+	pid, _ := parseLogID(m.ProcessID)
+	tid, _ := parseLogID(m.ThreadID)
 	respBytes, _ := strconv.ParseInt(string(m.ResponseBytes), 16, 64)
 	respDuration, _ := strconv.ParseFloat(string(m.ResponseDuration), 64)
 	j := logglyJsonMsg{
@@ -160,40 +250,45 @@ func (m *LogMsg) toLogglyJson(target *json.Encoder) error {
 		ResponseBytes:    respBytes,
 		ResponseDuration: respDuration,
 		JavaClass:        string(m.JavaClass),
+		Truncated:        m.Truncated,
 	}
 	return target.Encode(&j)
 }
 
+func newDatadogReceiver(s *Scraper, timeout time.Duration) *DatadogReceiver {
+	dr := new(DatadogReceiver)
+	dr.s = s
+	dr.client = &http.Client{Timeout: timeout}
+	return dr
+}
+
 /*
 Assigns specific configuration for the Datadog receiver based on
-the installed agent's configuration. This includes the API key
-and hostname.
+the installed agent's configuration. This includes the API key,
+hostname, endpoint (from site or dd_url), proxy and tags.
 */
 func (dr *DatadogReceiver) readDatadogCfg(filename string) error {
-	file, err := os.Open(filename)
+	cfg, err := readDatadogAgentConfig(filename)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if strings.HasPrefix(line, "#") {
-			continue
-		}
-
-		if strings.HasPrefix(line, "api_key:") {
-			dr.ApiKey = strings.TrimSpace(strings.Split(line, ":")[1])
-
-		} else if strings.HasPrefix(line, "hostname:") {
-			dr.Host = strings.TrimSpace(strings.Split(line, ":")[1])
-		}
+	client, err := cfg.Proxy.client()
+	if err != nil {
+		return err
+	}
+	dr.ApiKey = strings.TrimSpace(cfg.ApiKey)
+	dr.Host = strings.TrimSpace(cfg.Hostname)
+	dr.URL = cfg.eventsURL()
+	dr.Tags = cfg.Tags
+	if client != nil {
+		client.Timeout = dr.client.Timeout
+		dr.client = client
 	}
 
 	if dr.ApiKey == "" {
 		return errors.New("No Datadog API key found")
 	}
+	dr.s.secrets.track(dr.ApiKey)
 	//Use machine name if configured hostname is not specified.
 	//This is how the Datadog agent behaves.
 	if dr.Host == "" {
@@ -208,24 +303,15 @@ Initialises the receivers and assigns them to the global variable map.
 */
 func InitialiseRelayers(s *Scraper) {
 
-	//Loggly
-	lgr := new(LogglyReceiver)
-	lgr.s = s
-	lgr.URL = "https://logs-01.loggly.com/bulk"
-	lgr.ApiKey = "9bc39e17-f062-4bef-9e28-b8456feaa999"
-	//lgr.LogEvents = make(chan []*LogMsg, 1000)
-	//go lgr.Run(lgr)
-	// No longer sending to Loggly
-	//receivers["Loggly"] = lgr
+	// No longer sending to Loggly. To send to Loggly, define a relay of type "loggly" in the config,
+	// with its apiKey taken from a secret.
 
 	//Datadog, only if env set and DD conf found
 	b, err := strconv.ParseBool(os.Getenv("IMQS_MONITOR"))
 	if err == nil && b {
-		dr := new(DatadogReceiver)
-		err1 := dr.readDatadogCfg("C:\\ProgramData\\Datadog\\datadog.yaml")
+		dr := newDatadogReceiver(s, datadogEventsTimeout)
+		err1 := dr.readDatadogCfg(s.DatadogConfig)
 		if err1 == nil {
-			dr.s = s
-			dr.URL = "https://app.datadoghq.com/api/v1/events"
 			//dr.LogEvents = make(chan []*LogMsg, 1000)
 			//go dr.Run(dr)
 			receivers["Datadog"] = dr
@@ -238,13 +324,177 @@ func InitialiseRelayers(s *Scraper) {
 }
 
 /*
-Notifies all receivers of new messages to be sent
+Creates a Datadog events receiver from its definition in config. If no API key is
+given, we read it from the Datadog agent's configuration.
+*/
+func newDatadogRelay(s *Scraper, cfg *RelayConfig) (Relay, error) {
+	opt := struct {
+		URL            string   `json:"url"`  // Overrides site
+		Site           string   `json:"site"` // eg datadoghq.eu
+		ApiKey         string   `json:"apiKey"`
+		Host           string   `json:"host"`
+		Tags           []string `json:"tags"` // Added to those from the agent's config
+		AgentConfig    string   `json:"agentConfig"`
+		TimeoutSeconds int      `json:"timeoutSeconds"`
+	}{
+		AgentConfig:    s.DatadogConfig,
+		TimeoutSeconds: int(datadogEventsTimeout / time.Second),
+	}
+	if err := cfg.Decode(&opt); err != nil {
+		return nil, err
+	}
+	if opt.TimeoutSeconds <= 0 {
+		return nil, fmt.Errorf("Invalid Datadog timeoutSeconds %v", opt.TimeoutSeconds)
+	}
+	dr := newDatadogReceiver(s, time.Duration(opt.TimeoutSeconds)*time.Second)
+	if opt.ApiKey == "" {
+		if err := dr.readDatadogCfg(opt.AgentConfig); err != nil {
+			return nil, err
+		}
+	} else {
+		dr.ApiKey = opt.ApiKey
+		dr.Host = s.OwnHostname
+		dr.URL = datadogEventsURL
+	}
+	if opt.Site != "" {
+		dr.URL = (&datadogAgentConfig{Site: opt.Site}).eventsURL()
+	}
+	if opt.URL != "" {
+		dr.URL = opt.URL
+	}
+	if opt.Host != "" {
+		dr.Host = opt.Host
+	}
+	dr.Tags = append(dr.Tags, opt.Tags...)
+	return dr, nil
+}
+
+func newLogglyRelay(s *Scraper, cfg *RelayConfig) (Relay, error) {
+	opt := struct {
+		URL            string `json:"url"`
+		ApiKey         string `json:"apiKey"`
+		TimeoutSeconds int    `json:"timeoutSeconds"`
+	}{
+		URL:            "https://logs-01.loggly.com/bulk",
+		TimeoutSeconds: int(logglyTimeout / time.Second),
+	}
+	if err := cfg.Decode(&opt); err != nil {
+		return nil, err
+	}
+	if opt.ApiKey == "" {
+		return nil, errors.New("No Loggly API key specified")
+	}
+	if opt.TimeoutSeconds <= 0 {
+		return nil, fmt.Errorf("Invalid Loggly timeoutSeconds %v", opt.TimeoutSeconds)
+	}
+	lgr := new(LogglyReceiver)
+	lgr.s = s
+	lgr.URL = opt.URL
+	lgr.ApiKey = opt.ApiKey
+	lgr.client = &http.Client{Timeout: time.Duration(opt.TimeoutSeconds) * time.Second}
+	return lgr, nil
+}
+
+/*
+Creates the relays defined in config. Relays whose definitions are unchanged
+from those in current are reused, rather than created again. If any relay
+fails to be created, then we return an error, and close the relays that were
+already created.
 */
-func NotifyAllRelayers(messages []*LogMsg) {
-	for _, value := range receivers {
+func buildRelays(s *Scraper, configs []RelayConfig, current map[string]Relay, currentDefs map[string]string) (map[string]Relay, map[string]string, error) {
+	relays := make(map[string]Relay)
+	defs := make(map[string]string)
+	var created []Relay
+	fail := func(err error) (map[string]Relay, map[string]string, error) {
+		for _, r := range created {
+			closeRelay(r)
+		}
+		return nil, nil, err
+	}
+	for i := range configs {
+		cfg := &configs[i]
+		if cfg.Name == "" {
+			return fail(fmt.Errorf("Relay %v has no name", i+1))
+		}
+		if _, exists := relays[cfg.Name]; exists {
+			return fail(fmt.Errorf("There is more than one relay named %v", cfg.Name))
+		}
+		def := cfg.definition()
+		if r, ok := current[cfg.Name]; ok && currentDefs[cfg.Name] == def {
+			relays[cfg.Name] = r
+			defs[cfg.Name] = def
+			continue
+		}
+		r, err := s.newRelay(cfg)
+		if err != nil {
+			return fail(fmt.Errorf("Relay %v: %v", cfg.Name, err))
+		}
+		created = append(created, r)
+		relays[cfg.Name] = r
+		defs[cfg.Name] = def
+	}
+	return relays, defs, nil
+}
+
+// Create a relay from its definition
+func (s *Scraper) newRelay(cfg *RelayConfig) (Relay, error) {
+	factory, ok := relayFactories[cfg.Type]
+	if !ok {
+		return nil, fmt.Errorf("Relay type %v cannot be found", cfg.Type)
+	}
+	cfg.secrets = s.secrets
+	return factory(s, cfg)
+}
+
+// Flush a relay that is being retired, and release its resources
+func closeRelay(r Relay) {
+	if flusher, ok := r.(RelayFlusher); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		flusher.Flush(ctx)
+		cancel()
+	}
+	if closer, ok := r.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+func currentRelayers() map[string]Relay {
+	receiversLock.RLock()
+	defer receiversLock.RUnlock()
+	return receivers
+}
+
+func setRelayers(relays map[string]Relay) {
+	receiversLock.Lock()
+	receivers = relays
+	receiversLock.Unlock()
+}
+
+/*
+Notifies all receivers of new messages to be sent, and returns the outcome
+for each receiver, by name.
+*/
+func NotifyAllRelayers(messages []*LogMsg) map[string]error {
+	relays := currentRelayers()
+	results := make(map[string]error, len(relays))
+	for name, value := range relays {
 		//value.Receive(messages)
-		value.Send(messages)
+		results[name] = value.Send(messages)
+	}
+	return results
+}
+
+/*
+Flushes all receivers that buffer messages, and returns the outcome for each of them, by name.
+*/
+func FlushAllRelayers(ctx context.Context) map[string]error {
+	results := make(map[string]error)
+	for name, value := range currentRelayers() {
+		if flusher, ok := value.(RelayFlusher); ok {
+			results[name] = flusher.Flush(ctx)
+		}
 	}
+	return results
 }
 
 /*
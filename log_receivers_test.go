@@ -0,0 +1,101 @@
+package logscraper
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDatadogReceiverSend(t *testing.T) {
+	cases := []struct {
+		name     string
+		statuses map[string]int // Response to the event whose text contains the key. 200 otherwise.
+		posted   []string
+		sent     int // Messages accepted, if we expect a partialError
+		fail     bool
+	}{
+		{name: "all accepted", posted: []string{"one", "three", "four"}},
+		{name: "one rejected", statuses: map[string]int{"three": 400}, posted: []string{"one", "three", "four"}},
+		{name: "server error", statuses: map[string]int{"three": 503}, posted: []string{"one", "three"}, sent: 2, fail: true},
+		{name: "rate limited", statuses: map[string]int{"one": 429}, posted: []string{"one"}, sent: 0, fail: true},
+	}
+	for _, c := range cases {
+		var posted []string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			raw, _ := ioutil.ReadAll(r.Body)
+			for _, text := range []string{"one", "two", "three", "four"} {
+				if strings.Contains(string(raw), `"text":"`+text+`"`) {
+					posted = append(posted, text)
+					if status, ok := c.statuses[text]; ok {
+						w.WriteHeader(status)
+					}
+				}
+			}
+		}))
+		dr := newDatadogReceiver(NewScraper("host", "ownhost", "", ""), datadogEventsTimeout)
+		dr.Host = "host"
+		dr.URL = server.URL
+		messages := []*LogMsg{
+			{Severity: []byte("E"), Source: []byte("a"), Message: []byte("one")},
+			{Severity: []byte("I"), Source: []byte("a"), Message: []byte("two")},
+			{Severity: []byte("E"), Source: []byte("a"), Message: []byte("three")},
+			{Severity: []byte("F"), Source: []byte("a"), Message: []byte("four")},
+		}
+		err := dr.Send(messages)
+		server.Close()
+
+		if strings.Join(posted, ",") != strings.Join(c.posted, ",") {
+			t.Errorf("%v: posted %v, expected %v", c.name, posted, c.posted)
+		}
+		var partial partialError
+		if !c.fail {
+			if err != nil {
+				t.Errorf("%v: %v", c.name, err)
+			}
+		} else if !errors.As(err, &partial) || partial.Sent != c.sent || isPermanent(err) {
+			t.Errorf("%v: returned %#v, expected a partialError after %v messages", c.name, err, c.sent)
+		}
+	}
+}
+
+// An endpoint that never answers must not hold up a worker for ever
+func TestRelayTimeouts(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	for _, def := range []string{
+		`"type": "loggly", "apiKey": "key"`,
+		`"type": "datadog", "apiKey": "key"`,
+	} {
+		s := NewScraper("host", "ownhost", "", "")
+		relay := newTestRelay(t, s, `{"name": "slow", "timeoutSeconds": 1, "url": "`+server.URL+`", `+def+`}`)
+		start := time.Now()
+		if err := relay.Send([]*LogMsg{{Severity: []byte("E"), Message: []byte("one")}}); err == nil {
+			t.Errorf("%v: Send succeeded without a response", def)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("%v: Send took %v to time out", def, elapsed)
+		}
+	}
+}
+
+// Create a relay from its definition in config
+func newTestRelay(t *testing.T, s *Scraper, def string) Relay {
+	var cfg RelayConfig
+	if err := json.Unmarshal([]byte(def), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	relay, err := s.newRelay(&cfg)
+	if err != nil {
+		t.Fatalf("Unable to create relay %v: %v", def, err)
+	}
+	return relay
+}
@@ -0,0 +1,306 @@
+package logscraper
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+/*
+LokiRelay pushes messages to Grafana Loki's /loki/api/v1/push. Loki stores messages in streams,
+one per distinct set of labels, so the relay groups messages by the values of the fields that
+are configured as labels, and sorts each stream by time, as Loki requires.
+
+Loki indexes every distinct stream, so labels must only be taken from fields with few values.
+We refuse fields such as client_ip or request as labels, since every distinct value would
+create a new stream, and quickly overwhelm Loki's index.
+
+The payload is either protobuf compressed with snappy (the default, and what Promtail sends),
+or plain JSON.
+*/
+
+const (
+	lokiPushPath       = "/loki/api/v1/push"
+	lokiMaxBatchBytes  = 1024 * 1024
+	lokiEncodingProto  = "protobuf"
+	lokiEncodingJson   = "json"
+	lokiDefaultLabels  = "host,source,level"
+	lokiLabelNameRegex = `^[a-zA-Z_][a-zA-Z0-9_]*$`
+	lokiTimeout        = 30 * time.Second
+)
+
+// The fields of LogMsg that may be used as labels
+var lokiLabelFields = map[string]func(m *LogMsg) string{
+	"host":        func(m *LogMsg) string { return string(m.Host) },
+	"ownhostname": func(m *LogMsg) string { return string(m.OwnHostname) },
+	"source":      func(m *LogMsg) string { return string(m.Source) },
+	"format":      func(m *LogMsg) string { return string(m.Format) },
+	"level":       func(m *LogMsg) string { return m.Level().String() },
+}
+
+// Fields that we refuse as labels, because of their cardinality
+var lokiHighCardinalityFields = map[string]bool{
+	"message":           true,
+	"severity":          true, // Use level, which has a handful of values, instead
+	"process_id":        true,
+	"thread_id":         true,
+	"client_ip":         true,
+	"request":           true,
+	"response_code":     true,
+	"response_bytes":    true,
+	"response_duration": true,
+	"java_class":        true,
+	"time":              true,
+}
+
+type LokiRelay struct {
+	s            *Scraper
+	URL          string
+	Labels       []string          // Keys of lokiLabelFields
+	StaticLabels map[string]string // Added to every stream, eg job
+	Encoding     string            // lokiEncodingProto or lokiEncodingJson
+	Username     string
+	Password     string
+	TenantID     string // Sent as X-Scope-OrgID, for multi-tenant Loki
+	client       *http.Client
+}
+
+type lokiStream struct {
+	labels  map[string]string
+	key     string // The labels, in Loki's {name="value"} form
+	entries []*LogMsg
+}
+
+func newLokiRelay(s *Scraper, cfg *RelayConfig) (Relay, error) {
+	opt := struct {
+		URL            string            `json:"url"`
+		Labels         []string          `json:"labels"`
+		StaticLabels   map[string]string `json:"staticLabels"`
+		Encoding       string            `json:"encoding"`
+		Username       string            `json:"username"`
+		Password       string            `json:"password"`
+		TenantID       string            `json:"tenantId"`
+		TimeoutSeconds int               `json:"timeoutSeconds"`
+	}{
+		Labels:         strings.Split(lokiDefaultLabels, ","),
+		Encoding:       lokiEncodingProto,
+		TimeoutSeconds: int(lokiTimeout / time.Second),
+	}
+	if err := cfg.Decode(&opt); err != nil {
+		return nil, err
+	}
+	if opt.URL == "" {
+		return nil, errors.New("No Loki URL specified")
+	}
+	u, err := url.Parse(opt.URL)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid Loki URL: %v", err)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = lokiPushPath
+	}
+	if opt.Encoding != lokiEncodingProto && opt.Encoding != lokiEncodingJson {
+		return nil, fmt.Errorf("Unknown Loki encoding %v. Expected %v or %v", opt.Encoding, lokiEncodingProto, lokiEncodingJson)
+	}
+	if opt.TimeoutSeconds <= 0 {
+		return nil, fmt.Errorf("Invalid Loki timeoutSeconds %v", opt.TimeoutSeconds)
+	}
+	for _, label := range opt.Labels {
+		if lokiHighCardinalityFields[label] {
+			return nil, fmt.Errorf("%v may not be a Loki label, because it has too many distinct values", label)
+		}
+		if lokiLabelFields[label] == nil {
+			return nil, fmt.Errorf("Unknown Loki label %v. Expected one of host, ownhostname, source, format or level", label)
+		}
+	}
+	nameRegex := regexp.MustCompile(lokiLabelNameRegex)
+	for name := range opt.StaticLabels {
+		if !nameRegex.MatchString(name) {
+			return nil, fmt.Errorf("Invalid Loki label name %v", name)
+		}
+	}
+	return &LokiRelay{
+		s:            s,
+		URL:          u.String(),
+		Labels:       opt.Labels,
+		StaticLabels: opt.StaticLabels,
+		Encoding:     opt.Encoding,
+		Username:     opt.Username,
+		Password:     opt.Password,
+		TenantID:     opt.TenantID,
+		client:       &http.Client{Timeout: time.Duration(opt.TimeoutSeconds) * time.Second},
+	}, nil
+}
+
+func (lr *LokiRelay) Send(messages []*LogMsg) error {
+	start, size := 0, 0
+	for i, m := range messages {
+		if i != start && size+len(m.Message) > lokiMaxBatchBytes {
+			if err := lr.push(messages[start:i]); err != nil {
+				return err
+			}
+			start, size = i, 0
+		}
+		size += len(m.Message)
+	}
+	if start == len(messages) {
+		return nil
+	}
+	return lr.push(messages[start:])
+}
+
+// Group the messages into streams, each sorted by time
+func (lr *LokiRelay) streams(messages []*LogMsg) []*lokiStream {
+	byKey := make(map[string]*lokiStream)
+	var streams []*lokiStream
+	for _, m := range messages {
+		labels := make(map[string]string, len(lr.Labels)+len(lr.StaticLabels))
+		for name, value := range lr.StaticLabels {
+			labels[name] = value
+		}
+		for _, name := range lr.Labels {
+			if value := lokiLabelFields[name](m); value != "" {
+				labels[name] = value
+			}
+		}
+		key := lokiLabelString(labels)
+		stream := byKey[key]
+		if stream == nil {
+			stream = &lokiStream{labels: labels, key: key}
+			byKey[key] = stream
+			streams = append(streams, stream)
+		}
+		stream.entries = append(stream.entries, m)
+	}
+	for _, stream := range streams {
+		entries := stream.entries
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+	}
+	return streams
+}
+
+// Returns the labels in Loki's {name="value", ...} form, sorted by name
+func lokiLabelString(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i != 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(labels[name]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func (lr *LokiRelay) push(messages []*LogMsg) error {
+	streams := lr.streams(messages)
+	var body []byte
+	var contentType string
+	if lr.Encoding == lokiEncodingJson {
+		body = encodeLokiJson(streams)
+		contentType = "application/json"
+	} else {
+		body = snappy.Encode(nil, encodeLokiProto(streams))
+		contentType = "application/x-protobuf"
+	}
+
+	req, err := http.NewRequest("POST", lr.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if lr.Username != "" {
+		req.SetBasicAuth(lr.Username, lr.Password)
+	}
+	if lr.TenantID != "" {
+		req.Header.Set("X-Scope-OrgID", lr.TenantID)
+	}
+	resp, err := lr.client.Do(req)
+	if err != nil {
+		lr.s.logMetaf("Error pushing to Loki: %v", err)
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		// Loki explains why it rejected a push (eg entries too far out of order) in the body
+		reason, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 500))
+		lr.s.logMetaf("Loki rejected push: %v: %s", err, bytes.TrimSpace(reason))
+		return err
+	}
+	return nil
+}
+
+func encodeLokiJson(streams []*lokiStream) []byte {
+	type jsonStream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	}
+	req := struct {
+		Streams []jsonStream `json:"streams"`
+	}{}
+	for _, stream := range streams {
+		js := jsonStream{Stream: stream.labels}
+		for _, m := range stream.entries {
+			js.Values = append(js.Values, [2]string{strconv.FormatInt(m.Time.UnixNano(), 10), string(m.Message)})
+		}
+		req.Streams = append(req.Streams, js)
+	}
+	raw, _ := json.Marshal(&req)
+	return raw
+}
+
+/*
+Encodes a logproto.PushRequest by hand, which saves us from depending on Loki itself:
+
+	message PushRequest  { repeated StreamAdapter streams = 1; }
+	message StreamAdapter { string labels = 1; repeated EntryAdapter entries = 2; }
+	message EntryAdapter  { google.protobuf.Timestamp timestamp = 1; string line = 2; }
+*/
+func encodeLokiProto(streams []*lokiStream) []byte {
+	var req []byte
+	for _, stream := range streams {
+		var s []byte
+		s = protowire.AppendTag(s, 1, protowire.BytesType)
+		s = protowire.AppendString(s, stream.key)
+		for _, m := range stream.entries {
+			var ts []byte
+			ts = protowire.AppendTag(ts, 1, protowire.VarintType)
+			ts = protowire.AppendVarint(ts, uint64(m.Time.Unix()))
+			ts = protowire.AppendTag(ts, 2, protowire.VarintType)
+			ts = protowire.AppendVarint(ts, uint64(m.Time.Nanosecond()))
+
+			var e []byte
+			e = protowire.AppendTag(e, 1, protowire.BytesType)
+			e = protowire.AppendBytes(e, ts)
+			e = protowire.AppendTag(e, 2, protowire.BytesType)
+			e = protowire.AppendBytes(e, m.Message)
+
+			s = protowire.AppendTag(s, 2, protowire.BytesType)
+			s = protowire.AppendBytes(s, e)
+		}
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, s)
+	}
+	return req
+}
@@ -0,0 +1,38 @@
+package logscraper
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// Encrypt the machine key with DPAPI, in the machine's scope, so that any account on this
+// machine (eg the service account) can unlock it, but nobody can on another machine.
+func protectMachineKey(key []byte) ([]byte, error) {
+	in := windows.DataBlob{Size: uint32(len(key)), Data: &key[0]}
+	var out windows.DataBlob
+	err := windows.CryptProtectData(&in, nil, nil, 0, nil, windows.CRYPTPROTECT_LOCAL_MACHINE|windows.CRYPTPROTECT_UI_FORBIDDEN, &out)
+	if err != nil {
+		return nil, err
+	}
+	return takeDataBlob(&out), nil
+}
+
+func unprotectMachineKey(raw []byte) ([]byte, error) {
+	if len(raw) == 0 {
+		return nil, windows.ERROR_INVALID_DATA
+	}
+	in := windows.DataBlob{Size: uint32(len(raw)), Data: &raw[0]}
+	var out windows.DataBlob
+	err := windows.CryptUnprotectData(&in, nil, nil, 0, nil, windows.CRYPTPROTECT_UI_FORBIDDEN, &out)
+	if err != nil {
+		return nil, err
+	}
+	return takeDataBlob(&out), nil
+}
+
+// Copy out the contents of a blob that was allocated by DPAPI, and free it
+func takeDataBlob(blob *windows.DataBlob) []byte {
+	defer windows.LocalFree(windows.Handle(unsafe.Pointer(blob.Data)))
+	return append([]byte(nil), unsafe.Slice(blob.Data, blob.Size)...)
+}
@@ -0,0 +1,661 @@
+package logscraper
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	_ "google.golang.org/grpc/encoding/gzip" // Registers the gzip compressor
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+/*
+OtlpRelay exports messages as OpenTelemetry log records, usually to a local OpenTelemetry
+Collector, which can then send them on to whatever backends it is configured for. The protocol
+is one of:
+
+	http/protobuf  POST to /v1/logs (the default, and the collector listens on port 4318)
+	http/json      The same, but JSON
+	grpc           The LogsService/Export RPC (the collector listens on port 4317)
+
+Messages are grouped by resource, which is described by these attributes:
+
+	host.name               Host
+	logscraper.ownhostname  OwnHostname
+	service.name            The name of the log source
+
+plus any resourceAttributes from the relay's configuration. The rest of a message's fields become
+attributes of its log record, and its trace and span IDs are those found by TraceContext.
+
+A collector that rejects a request as malformed (HTTP 400 or InvalidArgument) won't accept it
+when we send it again, so we log and drop it. Any other failure is returned, and relayMessages
+then sends the same messages again on the next pass.
+*/
+
+const (
+	otlpProtocolProto = "http/protobuf"
+	otlpProtocolJson  = "http/json"
+	otlpProtocolGrpc  = "grpc"
+	otlpLogsPath      = "/v1/logs"
+	otlpExportMethod  = "/opentelemetry.proto.collector.logs.v1.LogsService/Export"
+	otlpDefaultHttp   = "http://localhost:4318"
+	otlpDefaultGrpc   = "http://localhost:4317"
+	otlpMaxBatchBytes = 3 * 1024 * 1024 // gRPC servers refuse messages of more than 4MB by default
+	otlpTimeout       = 30 * time.Second
+	otlpScopeName     = "logscraper"
+)
+
+var otlpSeverityNumbers = map[Level]int{
+	LevelUnknown: 0,
+	LevelTrace:   1,
+	LevelDebug:   5,
+	LevelInfo:    9,
+	LevelWarning: 13,
+	LevelError:   17,
+	LevelFatal:   21,
+}
+
+type OtlpRelay struct {
+	s                  *Scraper
+	Protocol           string
+	Endpoint           string            // The URL for http, or host:port for grpc
+	Headers            map[string]string // eg for authentication
+	ResourceAttributes map[string]string // Added to every resource, eg deployment.environment
+	Gzip               bool
+	Timeout            time.Duration // Of each export
+	client             *http.Client  // For http
+	grpcCredentials    credentials.TransportCredentials
+	lock               sync.Mutex
+	conn               *grpc.ClientConn // Created by the first Send over grpc
+}
+
+// An attribute, whose value is a string, int64 or bool
+type otlpAttribute struct {
+	key   string
+	value interface{}
+}
+
+// The messages that share a resource
+type otlpResource struct {
+	attributes []otlpAttribute
+	messages   []*LogMsg
+}
+
+func newOtlpRelay(s *Scraper, cfg *RelayConfig) (Relay, error) {
+	opt := struct {
+		Protocol           string            `json:"protocol"`
+		Endpoint           string            `json:"endpoint"`
+		Headers            map[string]string `json:"headers"`
+		ResourceAttributes map[string]string `json:"resourceAttributes"`
+		Compression        string            `json:"compression"`
+		Insecure           bool              `json:"insecure"` // grpc without TLS
+		CAFile             string            `json:"caFile"`
+		InsecureSkipVerify bool              `json:"insecureSkipVerify"`
+		TimeoutSeconds     int               `json:"timeoutSeconds"`
+	}{
+		Protocol:       otlpProtocolProto,
+		Compression:    "none",
+		TimeoutSeconds: int(otlpTimeout / time.Second),
+	}
+	if err := cfg.Decode(&opt); err != nil {
+		return nil, err
+	}
+	if opt.TimeoutSeconds <= 0 {
+		return nil, fmt.Errorf("Invalid OTLP timeoutSeconds %v", opt.TimeoutSeconds)
+	}
+	otr := &OtlpRelay{
+		s:                  s,
+		Protocol:           opt.Protocol,
+		Headers:            opt.Headers,
+		ResourceAttributes: opt.ResourceAttributes,
+		Timeout:            time.Duration(opt.TimeoutSeconds) * time.Second,
+	}
+	switch opt.Compression {
+	case "gzip":
+		otr.Gzip = true
+	case "none":
+	default:
+		return nil, fmt.Errorf("Unknown OTLP compression %v. Expected gzip or none", opt.Compression)
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: opt.InsecureSkipVerify}
+	if opt.CAFile != "" {
+		pool, err := loadCertPool(opt.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	switch opt.Protocol {
+	case otlpProtocolProto, otlpProtocolJson:
+		if opt.Endpoint == "" {
+			opt.Endpoint = otlpDefaultHttp
+		}
+		u, err := url.Parse(opt.Endpoint)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("Invalid OTLP endpoint %v. Expected a URL such as %v", opt.Endpoint, otlpDefaultHttp)
+		}
+		if u.Path == "" || u.Path == "/" {
+			u.Path = otlpLogsPath
+		}
+		otr.Endpoint = u.String()
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		if opt.CAFile != "" || opt.InsecureSkipVerify {
+			transport.TLSClientConfig = tlsConfig
+		}
+		otr.client = &http.Client{Transport: transport, Timeout: otr.Timeout}
+	case otlpProtocolGrpc:
+		if opt.Endpoint == "" {
+			opt.Endpoint = otlpDefaultGrpc
+		}
+		// Like the OpenTelemetry SDKs, we accept http://host:port to mean grpc without TLS
+		endpoint := opt.Endpoint
+		if u, err := url.Parse(endpoint); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+			endpoint = u.Host
+			if u.Scheme == "http" {
+				opt.Insecure = true
+			}
+		}
+		if !strings.Contains(endpoint, ":") {
+			return nil, fmt.Errorf("Invalid OTLP endpoint %v. Expected host:port", opt.Endpoint)
+		}
+		otr.Endpoint = endpoint
+		if opt.Insecure {
+			otr.grpcCredentials = insecure.NewCredentials()
+		} else {
+			otr.grpcCredentials = credentials.NewTLS(tlsConfig)
+		}
+	default:
+		return nil, fmt.Errorf("Unknown OTLP protocol %v. Expected %v, %v or %v", opt.Protocol, otlpProtocolProto, otlpProtocolJson, otlpProtocolGrpc)
+	}
+	return otr, nil
+}
+
+func (otr *OtlpRelay) Send(messages []*LogMsg) error {
+	otr.lock.Lock()
+	defer otr.lock.Unlock()
+	start, size := 0, 0
+	for i, m := range messages {
+		if i != start && size+len(m.Message) > otlpMaxBatchBytes {
+			if err := otr.export(messages[start:i]); err != nil {
+				return err
+			}
+			start, size = i, 0
+		}
+		size += len(m.Message)
+	}
+	if start == len(messages) {
+		return nil
+	}
+	return otr.export(messages[start:])
+}
+
+func (otr *OtlpRelay) export(messages []*LogMsg) error {
+	resources := otr.resources(messages)
+	var err error
+	if otr.Protocol == otlpProtocolGrpc {
+		err = otr.exportGrpc(encodeOtlpProto(resources))
+	} else {
+		err = otr.exportHttp(resources)
+	}
+	if err != nil {
+		otr.s.logMetaf("Error exporting to OTLP endpoint %v: %v", otr.Endpoint, err)
+	}
+	return err
+}
+
+// Group the messages by resource
+func (otr *OtlpRelay) resources(messages []*LogMsg) []*otlpResource {
+	type resourceKey struct {
+		host, ownHostname, source string
+	}
+	byKey := make(map[resourceKey]*otlpResource)
+	var resources []*otlpResource
+	for _, m := range messages {
+		key := resourceKey{string(m.Host), string(m.OwnHostname), string(m.Source)}
+		r := byKey[key]
+		if r == nil {
+			r = &otlpResource{}
+			for _, a := range []otlpAttribute{{"host.name", key.host}, {"logscraper.ownhostname", key.ownHostname}, {"service.name", key.source}} {
+				if a.value != "" {
+					r.attributes = append(r.attributes, a)
+				}
+			}
+			for name, value := range otr.ResourceAttributes {
+				r.attributes = append(r.attributes, otlpAttribute{name, value})
+			}
+			byKey[key] = r
+			resources = append(resources, r)
+		}
+		r.messages = append(r.messages, m)
+	}
+	return resources
+}
+
+// Returns the attributes of a log record, which are the fields of the message that aren't part
+// of its resource, or a field of the log record itself
+func otlpRecordAttributes(m *LogMsg) []otlpAttribute {
+	var attributes []otlpAttribute
+	add := func(key string, value []byte) {
+		if len(value) != 0 {
+			attributes = append(attributes, otlpAttribute{key, string(value)})
+		}
+	}
+	// Semantic conventions ask for integers, but we keep whatever the log has if it isn't one
+	addInt := func(key string, value []byte, parse func([]byte) (int64, error)) {
+		if n, err := parse(value); err == nil {
+			attributes = append(attributes, otlpAttribute{key, n})
+		} else {
+			add(key, value)
+		}
+	}
+	parseDecimal := func(value []byte) (int64, error) {
+		return strconv.ParseInt(string(value), 10, 64)
+	}
+	add("logscraper.format", m.Format)
+	if len(m.ProcessID) != 0 {
+		addInt("process.pid", m.ProcessID, parseLogID)
+	}
+	if len(m.ThreadID) != 0 {
+		addInt("thread.id", m.ThreadID, parseLogID)
+	}
+	add("client.address", m.ClientIP)
+	add("logscraper.request", m.Request)
+	if len(m.ResponseCode) != 0 {
+		addInt("http.response.status_code", m.ResponseCode, parseDecimal)
+	}
+	add("logscraper.response_bytes", m.ResponseBytes)
+	add("logscraper.response_duration", m.ResponseDuration)
+	add("code.namespace", m.JavaClass)
+	if m.Truncated {
+		attributes = append(attributes, otlpAttribute{"logscraper.truncated", true})
+	}
+	return attributes
+}
+
+// SeverityText is the severity as it appears in the log, or if there is none, our Level
+func otlpSeverityText(m *LogMsg) string {
+	if len(m.Severity) != 0 {
+		return string(m.Severity)
+	}
+	return m.Level().String()
+}
+
+/*
+Encodes an ExportLogsServiceRequest by hand, so that we don't depend on the generated OTLP packages:
+
+	message ExportLogsServiceRequest { repeated ResourceLogs resource_logs = 1; }
+	message ResourceLogs  { Resource resource = 1; repeated ScopeLogs scope_logs = 2; }
+	message Resource      { repeated KeyValue attributes = 1; }
+	message ScopeLogs     { InstrumentationScope scope = 1; repeated LogRecord log_records = 2; }
+	message InstrumentationScope { string name = 1; }
+	message LogRecord     { fixed64 time_unix_nano = 1; SeverityNumber severity_number = 2; string severity_text = 3;
+	                        AnyValue body = 5; repeated KeyValue attributes = 6; bytes trace_id = 9; bytes span_id = 10;
+	                        fixed64 observed_time_unix_nano = 11; }
+	message KeyValue      { string key = 1; AnyValue value = 2; }
+	message AnyValue      { oneof value { string string_value = 1; bool bool_value = 2; int64 int_value = 3; } }
+*/
+func encodeOtlpProto(resources []*otlpResource) []byte {
+	observed := uint64(time.Now().UnixNano())
+	var req []byte
+	for _, r := range resources {
+		var resource []byte
+		for _, a := range r.attributes {
+			resource = appendOtlpKeyValue(resource, 1, a)
+		}
+
+		var scope []byte
+		scope = protowire.AppendTag(scope, 1, protowire.BytesType)
+		scope = protowire.AppendBytes(scope, protowire.AppendString(protowire.AppendTag(nil, 1, protowire.BytesType), otlpScopeName))
+		for _, m := range r.messages {
+			var rec []byte
+			rec = protowire.AppendTag(rec, 1, protowire.Fixed64Type)
+			rec = protowire.AppendFixed64(rec, uint64(m.Time.UnixNano()))
+			if n := otlpSeverityNumbers[m.Level()]; n != 0 {
+				rec = protowire.AppendTag(rec, 2, protowire.VarintType)
+				rec = protowire.AppendVarint(rec, uint64(n))
+			}
+			if text := otlpSeverityText(m); text != "" {
+				rec = protowire.AppendTag(rec, 3, protowire.BytesType)
+				rec = protowire.AppendString(rec, text)
+			}
+			rec = protowire.AppendTag(rec, 5, protowire.BytesType)
+			rec = protowire.AppendBytes(rec, appendOtlpAnyValue(nil, string(m.Message)))
+			for _, a := range otlpRecordAttributes(m) {
+				rec = appendOtlpKeyValue(rec, 6, a)
+			}
+			traceID, spanID := m.TraceContext()
+			if id, err := hex.DecodeString(string(traceID)); err == nil && len(id) == 16 {
+				rec = protowire.AppendTag(rec, 9, protowire.BytesType)
+				rec = protowire.AppendBytes(rec, id)
+			}
+			if id, err := hex.DecodeString(string(spanID)); err == nil && len(id) == 8 {
+				rec = protowire.AppendTag(rec, 10, protowire.BytesType)
+				rec = protowire.AppendBytes(rec, id)
+			}
+			rec = protowire.AppendTag(rec, 11, protowire.Fixed64Type)
+			rec = protowire.AppendFixed64(rec, observed)
+
+			scope = protowire.AppendTag(scope, 2, protowire.BytesType)
+			scope = protowire.AppendBytes(scope, rec)
+		}
+
+		var rl []byte
+		rl = protowire.AppendTag(rl, 1, protowire.BytesType)
+		rl = protowire.AppendBytes(rl, resource)
+		rl = protowire.AppendTag(rl, 2, protowire.BytesType)
+		rl = protowire.AppendBytes(rl, scope)
+
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, rl)
+	}
+	return req
+}
+
+func appendOtlpKeyValue(b []byte, field protowire.Number, a otlpAttribute) []byte {
+	var kv []byte
+	kv = protowire.AppendTag(kv, 1, protowire.BytesType)
+	kv = protowire.AppendString(kv, a.key)
+	kv = protowire.AppendTag(kv, 2, protowire.BytesType)
+	kv = protowire.AppendBytes(kv, appendOtlpAnyValue(nil, a.value))
+	b = protowire.AppendTag(b, field, protowire.BytesType)
+	return protowire.AppendBytes(b, kv)
+}
+
+func appendOtlpAnyValue(b []byte, value interface{}) []byte {
+	switch v := value.(type) {
+	case string:
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, v)
+	case bool:
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(v))
+	case int64:
+		b = protowire.AppendTag(b, 3, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(v))
+	}
+	return b
+}
+
+// The JSON form of OTLP is the protobuf JSON mapping, except that trace and span IDs are hex
+// rather than base64. 64-bit integers are strings.
+type otlpJsonAnyValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+	IntValue    string  `json:"intValue,omitempty"`
+}
+
+type otlpJsonKeyValue struct {
+	Key   string           `json:"key"`
+	Value otlpJsonAnyValue `json:"value"`
+}
+
+type otlpJsonLogRecord struct {
+	TimeUnixNano         string             `json:"timeUnixNano"`
+	ObservedTimeUnixNano string             `json:"observedTimeUnixNano"`
+	SeverityNumber       int                `json:"severityNumber,omitempty"`
+	SeverityText         string             `json:"severityText,omitempty"`
+	Body                 otlpJsonAnyValue   `json:"body"`
+	Attributes           []otlpJsonKeyValue `json:"attributes,omitempty"`
+	TraceID              string             `json:"traceId,omitempty"`
+	SpanID               string             `json:"spanId,omitempty"`
+}
+
+func otlpJsonValue(value interface{}) otlpJsonAnyValue {
+	switch v := value.(type) {
+	case string:
+		return otlpJsonAnyValue{StringValue: &v}
+	case bool:
+		return otlpJsonAnyValue{BoolValue: &v}
+	case int64:
+		return otlpJsonAnyValue{IntValue: strconv.FormatInt(v, 10)}
+	}
+	return otlpJsonAnyValue{}
+}
+
+func otlpJsonAttributes(attributes []otlpAttribute) []otlpJsonKeyValue {
+	var kvs []otlpJsonKeyValue
+	for _, a := range attributes {
+		kvs = append(kvs, otlpJsonKeyValue{Key: a.key, Value: otlpJsonValue(a.value)})
+	}
+	return kvs
+}
+
+func encodeOtlpJson(resources []*otlpResource) []byte {
+	type scopeLogs struct {
+		Scope      map[string]string   `json:"scope"`
+		LogRecords []otlpJsonLogRecord `json:"logRecords"`
+	}
+	type resourceLogs struct {
+		Resource struct {
+			Attributes []otlpJsonKeyValue `json:"attributes"`
+		} `json:"resource"`
+		ScopeLogs []scopeLogs `json:"scopeLogs"`
+	}
+	req := struct {
+		ResourceLogs []resourceLogs `json:"resourceLogs"`
+	}{}
+	observed := strconv.FormatInt(time.Now().UnixNano(), 10)
+	for _, r := range resources {
+		rl := resourceLogs{}
+		rl.Resource.Attributes = otlpJsonAttributes(r.attributes)
+		sl := scopeLogs{Scope: map[string]string{"name": otlpScopeName}}
+		for _, m := range r.messages {
+			traceID, spanID := m.TraceContext()
+			sl.LogRecords = append(sl.LogRecords, otlpJsonLogRecord{
+				TimeUnixNano:         strconv.FormatInt(m.Time.UnixNano(), 10),
+				ObservedTimeUnixNano: observed,
+				SeverityNumber:       otlpSeverityNumbers[m.Level()],
+				SeverityText:         otlpSeverityText(m),
+				Body:                 otlpJsonValue(string(m.Message)),
+				Attributes:           otlpJsonAttributes(otlpRecordAttributes(m)),
+				TraceID:              string(traceID),
+				SpanID:               string(spanID),
+			})
+		}
+		rl.ScopeLogs = []scopeLogs{sl}
+		req.ResourceLogs = append(req.ResourceLogs, rl)
+	}
+	raw, _ := json.Marshal(&req)
+	return raw
+}
+
+func (otr *OtlpRelay) exportHttp(resources []*otlpResource) error {
+	var body []byte
+	contentType := "application/x-protobuf"
+	if otr.Protocol == otlpProtocolJson {
+		body = encodeOtlpJson(resources)
+		contentType = "application/json"
+	} else {
+		body = encodeOtlpProto(resources)
+	}
+	if otr.Gzip {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(body)
+		zw.Close()
+		body = buf.Bytes()
+	}
+
+	req, err := http.NewRequest("POST", otr.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if otr.Gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	for name, value := range otr.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := otr.client.Do(req)
+	if err != nil {
+		return err
+	}
+	raw, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusBadRequest {
+		otr.s.logMetaf("OTLP endpoint %v rejected %v log records as malformed: %v", otr.Endpoint, countOtlpRecords(resources), truncateString(string(raw), 500))
+		return nil
+	}
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+	var rejected int64
+	var reason string
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		rejected, reason = decodeOtlpJsonResponse(raw)
+	} else {
+		rejected, reason = decodeOtlpProtoResponse(raw)
+	}
+	otr.logPartialSuccess(rejected, reason)
+	return nil
+}
+
+// Retrying a partial success would only duplicate the records that were accepted, so we just
+// report the ones that weren't
+func (otr *OtlpRelay) logPartialSuccess(rejected int64, reason string) {
+	if rejected != 0 || reason != "" {
+		otr.s.logMetaf("OTLP endpoint %v rejected %v log records: %v", otr.Endpoint, rejected, reason)
+	}
+}
+
+func countOtlpRecords(resources []*otlpResource) int {
+	n := 0
+	for _, r := range resources {
+		n += len(r.messages)
+	}
+	return n
+}
+
+// Decodes the partial_success of an ExportLogsServiceResponse:
+//
+//	message ExportLogsServiceResponse { ExportLogsPartialSuccess partial_success = 1; }
+//	message ExportLogsPartialSuccess  { int64 rejected_log_records = 1; string error_message = 2; }
+func decodeOtlpProtoResponse(raw []byte) (rejected int64, reason string) {
+	partial := otlpProtoField(raw, 1)
+	if v := otlpProtoField(partial, 1); v != nil {
+		n, _ := protowire.ConsumeVarint(v)
+		rejected = int64(n)
+	}
+	reason = string(otlpProtoField(partial, 2))
+	return
+}
+
+// Returns the value of the last occurrence of a field, which is the raw varint for varint fields,
+// and the contents of length-delimited fields. Returns nil if the field is absent or b is invalid.
+func otlpProtoField(b []byte, field protowire.Number) []byte {
+	var value []byte
+	for len(b) != 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil
+		}
+		b = b[n:]
+		size := protowire.ConsumeFieldValue(num, typ, b)
+		if size < 0 {
+			return nil
+		}
+		if num == field {
+			if typ == protowire.BytesType {
+				value, _ = protowire.ConsumeBytes(b)
+			} else {
+				value = b[:size]
+			}
+		}
+		b = b[size:]
+	}
+	return value
+}
+
+func decodeOtlpJsonResponse(raw []byte) (rejected int64, reason string) {
+	var resp struct {
+		PartialSuccess struct {
+			RejectedLogRecords json.RawMessage `json:"rejectedLogRecords"` // A string, although some send a number
+			ErrorMessage       string          `json:"errorMessage"`
+		} `json:"partialSuccess"`
+	}
+	if json.Unmarshal(raw, &resp) != nil {
+		return 0, ""
+	}
+	rejected, _ = strconv.ParseInt(strings.Trim(string(resp.PartialSuccess.RejectedLogRecords), `"`), 10, 64)
+	return rejected, resp.PartialSuccess.ErrorMessage
+}
+
+// Passes our hand-encoded protobuf straight through gRPC
+type otlpRawCodec struct{}
+
+func (otlpRawCodec) Marshal(v interface{}) ([]byte, error) {
+	return *(v.(*[]byte)), nil
+}
+
+func (otlpRawCodec) Unmarshal(data []byte, v interface{}) error {
+	*(v.(*[]byte)) = append([]byte(nil), data...)
+	return nil
+}
+
+func (otlpRawCodec) Name() string {
+	return "proto"
+}
+
+func (otr *OtlpRelay) exportGrpc(req []byte) error {
+	if otr.conn == nil {
+		conn, err := grpc.NewClient(otr.Endpoint, grpc.WithTransportCredentials(otr.grpcCredentials))
+		if err != nil {
+			return err
+		}
+		otr.conn = conn
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), otr.Timeout)
+	defer cancel()
+	for name, value := range otr.Headers {
+		ctx = metadata.AppendToOutgoingContext(ctx, strings.ToLower(name), value)
+	}
+	options := []grpc.CallOption{grpc.ForceCodec(otlpRawCodec{})}
+	if otr.Gzip {
+		options = append(options, grpc.UseCompressor("gzip"))
+	}
+	var resp []byte
+	err := otr.conn.Invoke(ctx, otlpExportMethod, &req, &resp, options...)
+	if status.Code(err) == codes.InvalidArgument {
+		otr.s.logMetaf("OTLP endpoint %v rejected log records as malformed: %v", otr.Endpoint, err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	otr.logPartialSuccess(decodeOtlpProtoResponse(resp))
+	return nil
+}
+
+func (otr *OtlpRelay) Close() error {
+	otr.lock.Lock()
+	defer otr.lock.Unlock()
+	if otr.conn == nil {
+		return nil
+	}
+	err := otr.conn.Close()
+	otr.conn = nil
+	return err
+}
@@ -0,0 +1,39 @@
+package logscraper
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+// The OTLP and Loggly relays must report the same process and thread IDs for a message
+func TestOtlpProcessIDs(t *testing.T) {
+	cases := []struct {
+		pid, tid []byte
+		otlpPid  interface{}
+		otlpTid  interface{}
+		loggly   [2]int64
+	}{
+		{pid: []byte("0000001f"), otlpPid: int64(31), loggly: [2]int64{31, 0}},
+		{pid: []byte("10"), tid: []byte("a0"), otlpPid: int64(16), otlpTid: int64(160), loggly: [2]int64{16, 160}},
+		{pid: []byte("main"), otlpPid: "main", loggly: [2]int64{0, 0}},
+	}
+	for _, c := range cases {
+		m := &LogMsg{ProcessID: c.pid, ThreadID: c.tid}
+		attributes := map[string]interface{}{}
+		for _, a := range otlpRecordAttributes(m) {
+			attributes[a.key] = a.value
+		}
+		if attributes["process.pid"] != c.otlpPid || attributes["thread.id"] != c.otlpTid {
+			t.Errorf("%s/%s: OTLP has process.pid %#v and thread.id %#v, expected %#v and %#v", c.pid, c.tid, attributes["process.pid"], attributes["thread.id"], c.otlpPid, c.otlpTid)
+		}
+
+		var buf bytes.Buffer
+		m.toLogglyJson(json.NewEncoder(&buf))
+		var loggly logglyJsonMsg
+		json.Unmarshal(buf.Bytes(), &loggly)
+		if [2]int64{loggly.ProcessID, loggly.ThreadID} != c.loggly {
+			t.Errorf("%s/%s: Loggly has %v and %v, expected %v", c.pid, c.tid, loggly.ProcessID, loggly.ThreadID, c.loggly)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package logscraper
+
+import "os"
+
+/*
+Paths are the locations of the files that the scraper itself uses, as opposed to the logs that
+it scrapes. Each of them can be set in several places, of which the first that is not empty wins:
+
+ 1. Command line flags (eg -statefile)
+ 2. Environment variables (eg LOGSCRAPER_STATE_FILE)
+ 3. The "paths" section of the config file
+ 4. The defaults for the OS (see DefaultPaths)
+
+This lets the same binary run as a Windows service, on a Linux host, or in a container, where
+the environment is usually the most convenient place to point things elsewhere.
+*/
+type Paths struct {
+	StateFile     string `json:"stateFile,omitempty"`     // Where we store the positions in our log files
+	MetaLog       string `json:"metaLog,omitempty"`       // Where we log about ourselves
+	HostnameFile  string `json:"hostnameFile,omitempty"`  // Holds the hostname (or URL) that our messages are tagged with
+	DatadogConfig string `json:"datadogConfig,omitempty"` // The Datadog agent's config, which we read the API key from
+	Keystore      string `json:"keystore,omitempty"`      // Our encrypted secrets. See Keystore.
+	MachineKey    string `json:"machineKey,omitempty"`    // The key that the keystore is encrypted with
+}
+
+// Environment variables, in the same order as the fields of Paths
+const (
+	EnvStateFile     = "LOGSCRAPER_STATE_FILE"
+	EnvMetaLog       = "LOGSCRAPER_META_LOG"
+	EnvHostnameFile  = "LOGSCRAPER_HOSTNAME_FILE"
+	EnvDatadogConfig = "LOGSCRAPER_DATADOG_CONFIG"
+	EnvKeystore      = "LOGSCRAPER_KEYSTORE"
+	EnvMachineKey    = "LOGSCRAPER_MACHINE_KEY"
+)
+
+func PathsFromEnv() Paths {
+	return Paths{
+		StateFile:     os.Getenv(EnvStateFile),
+		MetaLog:       os.Getenv(EnvMetaLog),
+		HostnameFile:  os.Getenv(EnvHostnameFile),
+		DatadogConfig: os.Getenv(EnvDatadogConfig),
+		Keystore:      os.Getenv(EnvKeystore),
+		MachineKey:    os.Getenv(EnvMachineKey),
+	}
+}
+
+// Returns p, with its empty fields taken from fallback
+func (p Paths) Or(fallback Paths) Paths {
+	or := func(a, b string) string {
+		if a != "" {
+			return a
+		}
+		return b
+	}
+	return Paths{
+		StateFile:     or(p.StateFile, fallback.StateFile),
+		MetaLog:       or(p.MetaLog, fallback.MetaLog),
+		HostnameFile:  or(p.HostnameFile, fallback.HostnameFile),
+		DatadogConfig: or(p.DatadogConfig, fallback.DatadogConfig),
+		Keystore:      or(p.Keystore, fallback.Keystore),
+		MachineKey:    or(p.MachineKey, fallback.MachineKey),
+	}
+}
+
+// Combine the paths given on the command line with those from the environment, the config file
+// and the defaults, in order of precedence.
+func ResolvePaths(flags Paths, configFile string) (Paths, error) {
+	config, err := LoadServiceRegistryConfig(configFile)
+	if err != nil {
+		return Paths{}, err
+	}
+	return flags.Or(PathsFromEnv()).Or(config.Paths).Or(DefaultPaths()), nil
+}
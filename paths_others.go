@@ -0,0 +1,14 @@
+// +build !windows
+
+package logscraper
+
+func DefaultPaths() Paths {
+	return Paths{
+		StateFile:     "/var/lib/logscraper/scraper-state.json",
+		MetaLog:       "/var/log/logscraper/scraper.log",
+		HostnameFile:  "/etc/logscraper/hostname",
+		DatadogConfig: "/etc/datadog-agent/datadog.yaml",
+		Keystore:      "/etc/logscraper/keystore.json",
+		MachineKey:    "/etc/logscraper/machine.key",
+	}
+}
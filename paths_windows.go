@@ -0,0 +1,12 @@
+package logscraper
+
+func DefaultPaths() Paths {
+	return Paths{
+		StateFile:     "c:/imqsvar/logs/scraper-state.json",
+		MetaLog:       "c:/imqsvar/logs/scraper.log",
+		HostnameFile:  "c:/imqsbin/conf/hostname",
+		DatadogConfig: "C:\\ProgramData\\Datadog\\datadog.yaml",
+		Keystore:      "c:/imqsvar/conf/logscraper-keystore.json",
+		MachineKey:    "c:/imqsvar/conf/logscraper-machine.key",
+	}
+}
@@ -0,0 +1,154 @@
+package logscraper
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+Reload applies changes to the configuration without restarting. It reads from the same place
+that LoadConfiguration did, which is either the given file or the config service. It is
+triggered by SIGHUP, by a param change from the Windows service manager, by POST /reload on the
+admin API, or by the config watcher (see WatchConfig).
+
+The new configuration is validated in full (including the creation of any new relays) before
+anything is touched, so if it is invalid, we log why and carry on with the old one.
+
+Sources are matched up by name. A source whose definition is unchanged keeps its worker and its
+position. A source that was removed (or changed) is drained and retired, and its position is
+saved. A source that was added (or changed) picks up its position from the state store, just as
+it would on startup, and gets a worker of its own.
+
+Relays are only reloaded if the config has a "relays" section. Relays whose definitions are
+unchanged are kept, and relays that were removed are flushed and closed once the retired sources
+have been drained into them. Scraper-wide settings (hostnames, concurrency, etc) are not
+reloaded.
+*/
+
+const configCheckInterval = 5 * time.Second
+
+func (s *Scraper) Reload() error {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+
+	if !s.configLoaded {
+		return errors.New("No configuration to reload")
+	}
+	if s.runCtx == nil || s.runCtx.Err() != nil {
+		return errors.New("Scraper is not running")
+	}
+
+	// An empty configFile means the config service, as it did for LoadConfiguration
+	config, err := LoadServiceRegistryConfig(s.configFile)
+	if err != nil {
+		s.logMetaf("Reload failed, keeping the current configuration. Error opening configuration file: %v", err)
+		return err
+	}
+	newSources, errs := config.LogSources()
+	if len(errs) != 0 {
+		for _, err := range errs {
+			s.logMetaf("Reload failed, keeping the current configuration. Error parsing configuration file: %v", err)
+		}
+		return errors.New("Parsing configuration file failed")
+	}
+	var relays map[string]Relay
+	var relayDefs map[string]string
+	if len(config.Relays) != 0 {
+		relays, relayDefs, err = buildRelays(s, config.Relays, currentRelayers(), s.relayDefs)
+		if err != nil {
+			s.logMetaf("Reload failed, keeping the current configuration. Error creating relays: %v", err)
+			return err
+		}
+	}
+
+	// Work out which sources to keep, add and retire
+	current := s.sourceList()
+	byName := make(map[string]*LogSource)
+	for _, src := range current {
+		byName[src.Name] = src
+	}
+	var next, added, retired []*LogSource
+	kept := make(map[*LogSource]bool)
+	for _, src := range newSources {
+		if cur, ok := byName[src.Name]; ok && cur.definition == src.definition {
+			next = append(next, cur)
+			kept[cur] = true
+		} else {
+			next = append(next, src)
+			added = append(added, src)
+		}
+	}
+	for _, src := range current {
+		if !kept[src] {
+			retired = append(retired, src)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, src := range retired {
+		wg.Add(1)
+		go func(src *LogSource) {
+			defer wg.Done()
+			s.retireWorker(src)
+		}(src)
+	}
+	wg.Wait()
+	// The retired sources are still in the list, so this saves their final positions
+	s.saveState()
+
+	if relays != nil {
+		old := currentRelayers()
+		setRelayers(relays)
+		s.relayDefs = relayDefs
+		for name, r := range old {
+			if relays[name] != r {
+				closeRelay(r)
+			}
+		}
+	}
+
+	if s.state != nil && len(added) != 0 {
+		if saved, err := s.state.Load(); err != nil {
+			s.logMetaf("Unable to load state for new sources: %v", err)
+		} else {
+			s.restoreSources(added, saved)
+		}
+	}
+	s.setSources(next)
+	for _, src := range added {
+		s.startWorker(s.runCtx, src)
+		s.wakeSource(src)
+	}
+
+	s.logMetaf("Configuration reloaded. %v sources added, %v retired, %v unchanged.", len(added), len(retired), len(kept))
+	return nil
+}
+
+// Reload whenever the configuration file changes, until ctx is cancelled. We poll, rather than
+// use notifications, because editors replace files in all sorts of ways.
+func (s *Scraper) runConfigWatcher(ctx context.Context) {
+	last, _ := os.Stat(s.configFile)
+	ticker := time.NewTicker(configCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		info, err := os.Stat(s.configFile)
+		if err != nil {
+			// Probably busy being replaced. We'll try again on the next tick.
+			continue
+		}
+		if last != nil && info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size() {
+			continue
+		}
+		last = info
+		s.logMetaf("Configuration file %v has changed", s.configFile)
+		s.Reload()
+	}
+}
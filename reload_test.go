@@ -0,0 +1,60 @@
+package logscraper
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestConfig(t *testing.T, filename string, logs ...LogConfig) {
+	config := map[string]interface{}{
+		"services": []interface{}{map[string]interface{}{"logs": logs}},
+		"relays":   []interface{}{map[string]interface{}{"name": "file", "type": "file", "path": filepath.Join(filepath.Dir(filename), "relay.log")}},
+	}
+	raw, _ := json.Marshal(config)
+	if err := ioutil.WriteFile(filename, raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Reload may be called (eg by a signal) before Run has started, and while it is starting
+func TestReloadWhileStarting(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.json")
+	writeTestConfig(t, configFile, LogConfig{Name: "a", Filename: filepath.Join(dir, "a.log"), Parser: "go"})
+	s := NewScraper("host", "ownhost", filepath.Join(dir, "state.json"), filepath.Join(dir, "meta.log"))
+	defer setRelayers(currentRelayers())
+	if err := s.LoadConfiguration(configFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(); err == nil {
+		t.Error("Reload succeeded before Run")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	writeTestConfig(t, configFile,
+		LogConfig{Name: "a", Filename: filepath.Join(dir, "a.log"), Parser: "go"},
+		LogConfig{Name: "b", Filename: filepath.Join(dir, "b.log"), Parser: "go"})
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Reload() != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("Reload never succeeded")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if sources := s.sourceList(); len(sources) != 2 {
+		t.Errorf("Have %v sources after reloading, expected 2", len(sources))
+	}
+}
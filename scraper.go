@@ -16,15 +16,17 @@ package logscraper
 import (
 	"bufio"
 	"bytes"
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
 	"gopkg.in/natefinch/lumberjack.v2"
 	"io"
-	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
 	"time"
 )
 
@@ -54,12 +56,29 @@ func (l commonErrorLog) reset(err commonError) {
 //////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 
 type LogSource struct {
-	Filename  string
-	Name      string
-	Parse     Parser
-	firstLine []byte
-	lastPos   int64
-	errors    commonErrorLog
+	Filename     string
+	Name         string
+	Parse        Parser
+	ParserName   string        // Name of the parser in parsersByName
+	MaxLineSize  int           // Lines longer than this are truncated. Zero means use Scraper.MaxLineSize.
+	encoding     *textEncoding // nil means detect from the BOM, and fall back to UTF-8
+	StartPolicy  startPolicy   // Where to start reading when we have no state for the file
+	fresh        bool          // True until we've decided where to start, if we had no saved state
+	identity     string        // fileIdentity of the file that firstLine and lastPos refer to
+	firstLine    []byte
+	lastPos      int64                // The lowest of relayPos, which is where the next scan starts
+	relayPos     map[string]int64     // Position up to which each relay has accepted our messages. See relayMessages.
+	relayFailing map[string]time.Time // When each relay that is failing started to fail at its current position
+	errors       commonErrorLog
+	wake         chan struct{} // Signals the source's worker to scan it
+	lock         sync.Mutex    // Guards saved and dirty
+	saved        SourceState   // The state as of the end of the last scan, which is what saveState writes out
+	dirty        bool          // saved has changed since saveState last wrote it out
+	savedKey     string        // The key under which saveState last wrote our state. Only saveState touches this.
+	definition   string        // The source's configuration, so that Reload can tell whether it has changed
+	cancel       context.CancelFunc
+	retire       chan struct{} // Closed to make the worker drain the source and exit
+	done         chan struct{} // Closed when the worker exits
 }
 
 func NewLogSource(sourceName, filename string, parse Parser) *LogSource {
@@ -69,9 +88,71 @@ func NewLogSource(sourceName, filename string, parse Parser) *LogSource {
 		Parse:    parse,
 	}
 	s.errors = make(commonErrorLog)
+	s.relayPos = make(map[string]int64)
+	s.relayFailing = make(map[string]time.Time)
+	s.fresh = true
+	s.wake = make(chan struct{}, 1)
 	return s
 }
 
+// Publish the current state, so that saveState sees it. Only the source's worker may call this.
+func (src *LogSource) commit() {
+	st := SourceState{
+		Name:      src.Name,
+		Filename:  src.Filename,
+		Identity:  src.identity,
+		FirstLine: src.firstLine,
+		LastPos:   src.lastPos,
+		Relays:    make(map[string]int64, len(src.relayPos)),
+	}
+	for name, pos := range src.relayPos {
+		st.Relays[name] = pos
+	}
+	src.lock.Lock()
+	if !reflect.DeepEqual(st, src.saved) {
+		src.saved = st
+		src.dirty = true
+	}
+	src.lock.Unlock()
+}
+
+// Returns the committed state
+func (src *LogSource) snapshot() SourceState {
+	src.lock.Lock()
+	defer src.lock.Unlock()
+	return src.saved
+}
+
+// Returns the committed state, and whether it has changed since the last call
+func (src *LogSource) takeSnapshot() (SourceState, bool) {
+	src.lock.Lock()
+	defer src.lock.Unlock()
+	dirty := src.dirty
+	src.dirty = false
+	return src.saved, dirty
+}
+
+// Called when saving a snapshot failed, so that we try again next time
+func (src *LogSource) markDirty() {
+	src.lock.Lock()
+	src.dirty = true
+	src.lock.Unlock()
+}
+
+// Pick up where we left off. This must be called before the source's worker starts.
+func (src *LogSource) restore(st SourceState, key string) {
+	src.fresh = false
+	src.identity = st.Identity
+	src.firstLine = st.FirstLine
+	src.lastPos = st.LastPos
+	for name, pos := range st.Relays {
+		src.relayPos[name] = pos
+	}
+	src.commit()
+	src.dirty = key == ""
+	src.savedKey = key
+}
+
 //////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 
 // We separate LogMsg from logglyJsonMsg so that if we want to send our logs to a different format, it's straightforward.
@@ -91,36 +172,58 @@ type LogMsg struct {
 	ResponseBytes    []byte
 	ResponseDuration []byte
 	JavaClass        []byte
+	Format           []byte    // Name of the parser that understood the message, eg go or java
+	Truncated        bool      // One of the lines of the message exceeded the maximum line size, and was cut short
+	traceID          []byte    // 32 hex digits, if the message mentions one. See TraceContext.
+	spanID           []byte    // 16 hex digits, if the message mentions one
+	traceOnce        sync.Once // Guards the extraction of traceID and spanID
 }
 
-func (m *LogMsg) toMessageArray(hostname string, ownhostname string, source string, messages *[]*LogMsg) {
+func (m *LogMsg) toMessageArray(hostname string, ownhostname string, source string, format string, messages *[]*LogMsg) {
 	m.Host = []byte(hostname)
 	m.OwnHostname = []byte(ownhostname)
 	m.Source = []byte(source)
+	m.Format = []byte(format)
 	*messages = append(*messages, m)
 }
 
 //////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 
-type stateSourceJson struct {
-	FirstLine []byte
-	LastPos   int64
-}
-
-type stateJson struct {
-	Sources map[string]stateSourceJson
-}
-
-//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
-
 type Scraper struct {
-	Sources       []*LogSource
-	Hostname      string
-	OwnHostname   string
-	StateFilename string // Filename where we store our cached state (ie high-water mark of our log files)
-	PollInterval  time.Duration
-	SendToLoggly  bool
-	metaLogFile   io.Writer
+	Sources         []*LogSource
+	Hostname        string
+	OwnHostname     string
+	StateFilename   string // Filename where we store our cached state (ie high-water mark of our log files)
+	StateBackend    string // One of the StateBackend constants
+	PollInterval    time.Duration
+	Watch           bool          // React to file system notifications instead of only polling every PollInterval
+	WatchDebounce   time.Duration // Quiet period after a notification before a source is scanned
+	MaxConcurrency  int           // Maximum number of sources that are scanned at the same time
+	MaxBytesPerPass int64         // A source gives up its worker slot after scanning this many bytes, so that it cannot starve the others
+	MaxLineSize     int           // Lines longer than this are truncated, unless the source overrides it
+	RelayRetryLimit time.Duration // How long a relay may keep failing before we skip the messages that it can't take
+	ShutdownTimeout time.Duration // How long we wait for in-flight passes to finish when shutting down
+	AdminAddr       string        // Listen address of the admin API. Empty means no admin API.
+	WatchConfig     bool          // Reload the configuration file whenever it changes
+	DatadogConfig   string        // The Datadog agent's config file
+	SendToLoggly    bool
+	metaLogFile     io.Writer
+	secrets         *secretResolver
+	configFile      string            // The file that LoadConfiguration read. Empty means it came from the config service.
+	configLoaded    bool              // LoadConfiguration has succeeded, so Reload knows where to read from
+	relayDefs       map[string]string // Definitions of the relays that were created from config, by name
+	runCtx          context.Context   // The context given to Run, which the workers of new sources run under. Guarded by reloadLock.
+	reloadLock      sync.Mutex        // Serializes Reload, and keeps it out of shutdown
+	stopping        chan struct{}     // Closed once the context given to Run is cancelled, so that relays can cut long waits short
+	sourcesLock     sync.RWMutex      // Guards Sources, which is replaced as a whole (never modified in place) by Reload
+	sourcesChanged  chan struct{}     // Signals the watcher that Sources has been replaced
+	slots           chan struct{}     // Worker slots, of which there are MaxConcurrency
+	workers         sync.WaitGroup
+	control         *controller
+	state           StateStore
+	stateLock       sync.Mutex // Serializes saveState
+	stateDirty      int32      // Set (atomically) when a source has committed a new position
+	stateGCTime     time.Time  // When we last removed stale entries from the state store
 }
 
 func NewScraper(hostname, ownhostname, statefile, metalogfile string) *Scraper {
@@ -128,7 +231,31 @@ func NewScraper(hostname, ownhostname, statefile, metalogfile string) *Scraper {
 	s.Hostname = hostname
 	s.OwnHostname = ownhostname
 	s.PollInterval = 30 * time.Second
+	s.WatchDebounce = 500 * time.Millisecond
+	s.MaxConcurrency = 4
+	s.MaxBytesPerPass = 16 * 1024 * 1024
+	s.MaxLineSize = defaultMaxLineSize
+	s.RelayRetryLimit = 10 * time.Minute
+	s.ShutdownTimeout = 15 * time.Second
+	s.control = newController()
+	s.sourcesChanged = make(chan struct{}, 1)
+	s.stopping = make(chan struct{})
 	s.StateFilename = statefile
+	s.StateBackend = StateBackendJson
+	s.DatadogConfig = DefaultPaths().DatadogConfig
+	s.SetKeystore(DefaultPaths().Keystore, DefaultPaths().MachineKey)
+	s.SetMetaLogFile(metalogfile)
+	return s
+}
+
+// Set the location of the keystore that ${keystore:} secrets are read from. This must be
+// called before any relays are created.
+func (s *Scraper) SetKeystore(keystore, machineKey string) {
+	s.secrets = newSecretResolver(keystore, machineKey)
+}
+
+// Log about ourselves to metalogfile, or to stdout if it is empty
+func (s *Scraper) SetMetaLogFile(metalogfile string) {
 	if metalogfile != "" {
 		s.metaLogFile = &lumberjack.Logger{
 			Filename:   metalogfile,
@@ -138,7 +265,6 @@ func NewScraper(hostname, ownhostname, statefile, metalogfile string) *Scraper {
 	} else {
 		s.metaLogFile = os.Stdout
 	}
-	return s
 }
 
 func (s *Scraper) LoadConfiguration(file string) error {
@@ -156,33 +282,96 @@ func (s *Scraper) LoadConfiguration(file string) error {
 		return errors.New("Parsing configuration file failed")
 	}
 
-	s.Sources = append(s.Sources, logSources...)
-	for _, src := range s.Sources {
+	if len(config.Relays) != 0 {
+		relays, defs, err := buildRelays(s, config.Relays, nil, nil)
+		if err != nil {
+			s.logMetaf("Error creating relays: %v", err)
+			return err
+		}
+		setRelayers(relays)
+		s.relayDefs = defs
+	}
+
+	s.configFile = file
+	s.configLoaded = true
+	s.setSources(append(append([]*LogSource(nil), s.sourceList()...), logSources...))
+	for _, src := range s.sourceList() {
 		fmt.Printf("Source loaded: %v\n", src)
 	}
 	return nil
 }
 
-func (s *Scraper) Run() {
+// Returns the current list of sources. The list must not be modified.
+func (s *Scraper) sourceList() []*LogSource {
+	s.sourcesLock.RLock()
+	defer s.sourcesLock.RUnlock()
+	return s.Sources
+}
+
+func (s *Scraper) setSources(sources []*LogSource) {
+	s.sourcesLock.Lock()
+	s.Sources = sources
+	s.sourcesLock.Unlock()
+	select {
+	case s.sourcesChanged <- struct{}{}:
+	default:
+	}
+}
+
+// Run until ctx is cancelled, and then shut down gracefully. See shutdown().
+func (s *Scraper) Run(ctx context.Context) {
 	s.logMetaf("Scraper starting")
+	// Signal handlers may already be calling Reload, which reads runCtx
+	s.reloadLock.Lock()
+	s.runCtx = ctx
+	s.reloadLock.Unlock()
+	go func() {
+		<-ctx.Done()
+		close(s.stopping)
+	}()
+	s.openState()
 	s.loadState()
-	for {
-		for _, src := range s.Sources {
-			s.runSource(src)
+	s.startWorkers(ctx)
+	if s.AdminAddr != "" {
+		go s.runAdmin(ctx)
+	}
+	if s.WatchConfig && s.configFile != "" {
+		go s.runConfigWatcher(ctx)
+	}
+	if s.Watch {
+		if err := s.runWatcher(ctx); err != nil {
+			s.logMetaf("File notifications unavailable, falling back to polling: %v", err)
 		}
-		s.saveState()
-		time.Sleep(s.PollInterval)
 	}
+	if ctx.Err() == nil {
+		s.runPoller(ctx)
+	}
+	s.shutdown()
 	s.logMetaf("Scraper exiting")
 }
 
-func (s *Scraper) runSource(src *LogSource) {
+// Scan every source once per PollInterval
+func (s *Scraper) runPoller(ctx context.Context) {
+	ticker := time.NewTicker(s.PollInterval)
+	defer ticker.Stop()
+	for {
+		s.wakeAllSources()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Returns true if the source has more data that we didn't read, because it exceeded MaxBytesPerPass
+func (s *Scraper) runSource(src *LogSource) bool {
 	raw, err := os.Open(src.Filename)
 	if err != nil {
 		if src.errors.tick(commonErrorFileOpen) {
 			s.logMetaf("Error opening log file: %v", err)
 		}
-		return
+		return false
 	}
 	src.errors.reset(commonErrorFileOpen)
 	defer raw.Close()
@@ -190,23 +379,34 @@ func (s *Scraper) runSource(src *LogSource) {
 	fileLength, err := raw.Seek(0, os.SEEK_END)
 	if err != nil {
 		s.logMetaf("Unable to seek to END on %v: %v", src.Filename, err)
-		return
-	}
-	if fileLength < src.lastPos {
-		s.logMetaf("Looks like a rewind on %v", src.Filename)
+		return false
+	}
+	// If the file has a different identity to the one that we were reading, then it has been
+	// rolled, even if it has already grown past our old position.
+	identity := fileIdentity(raw)
+	replaced := src.identity != "" && identity != "" && identity != src.identity
+	if fileLength < src.lastPos || replaced {
+		if replaced {
+			s.logMetaf("%v has been replaced by a new file", src.Filename)
+		} else {
+			s.logMetaf("Looks like a rewind on %v", src.Filename)
+		}
 		// file has been rewound
 		if err := s.handleLogRoll(src); err != nil {
 			s.logMetaf("Log roll handling failed for %v: %v", src.Filename, err)
-			return
+			return false
 		}
 		if _, err := raw.Seek(0, os.SEEK_SET); err != nil {
 			s.logMetaf("Unable to seek to 0 on %v: %v", src.Filename, err)
-			return
+			return false
 		}
 		s.logMetaf("%v has been rewound", src.Filename)
 		src.lastPos = 0
 		src.firstLine = nil
+		src.relayPos = make(map[string]int64)
+		src.relayFailing = make(map[string]time.Time)
 	}
+	src.identity = identity
 
 	if src.lastPos == 0 {
 		if err := s.saveFileSignature(raw, src); err != nil {
@@ -215,81 +415,213 @@ func (s *Scraper) runSource(src *LogSource) {
 				// bytes in it for us to store a signature for it.
 				s.logMetaf("Failed to save file signature of %v: %v", src.Filename, err)
 			}
-			return
+			return false
 		} else {
 			s.logMetaf("Saved new signature of %v", src.Filename)
 			src.errors.reset(commonErrorSignatureSave)
 		}
 	}
 
+	if src.fresh {
+		// We have no state for this file, so the start policy decides where we begin
+		pos, err := s.startPosition(raw, src, fileLength)
+		if err != nil {
+			s.logMetaf("Unable to find start position (%v) of %v: %v", src.StartPolicy, src.Filename, err)
+			return false
+		}
+		if pos != src.lastPos {
+			s.logMetaf("Starting %v at offset %v of %v, because of start position '%v'", src.Filename, pos, fileLength, src.StartPolicy)
+		}
+		src.lastPos = pos
+		src.fresh = false
+	}
+
 	if _, err = raw.Seek(src.lastPos, os.SEEK_SET); err != nil {
 		s.logMetaf("Seek before scan failed: %v", err)
 	}
 
-	s.scan(raw, src)
+	return s.scan(raw, src, s.MaxBytesPerPass)
+}
 
+// The length at which we truncate lines of src
+func (s *Scraper) maxLineSize(src *LogSource) int {
+	if src.MaxLineSize > 0 {
+		return src.MaxLineSize
+	}
+	return s.MaxLineSize
 }
 
-func (s *Scraper) scan(logFile *os.File, src *LogSource) {
+// Scan messages from the current position of logFile, which must be src.lastPos. If budget is
+// greater than zero, we stop after roughly that many bytes, and return true to indicate that
+// there is more to read.
+func (s *Scraper) scan(logFile *os.File, src *LogSource, budget int64) bool {
+	enc, bomLen := src.detectEncoding(logFile)
+	if src.lastPos < int64(bomLen) {
+		if _, err := logFile.Seek(int64(bomLen), os.SEEK_SET); err != nil {
+			s.logMetaf("Unable to seek past BOM of %v: %v", src.Filename, err)
+			return false
+		}
+		src.lastPos = int64(bomLen)
+	}
+
 	scanner := bufio.NewScanner(logFile)
 
+	// We count the bytes consumed by the line splitter, instead of asking the file for its
+	// position afterwards, because the scanner reads ahead. This lets us stop in the middle
+	// of a file and still know exactly where to resume.
+	splitter := newLineSplitter(s.maxLineSize(src), enc)
+	splitter.attach(scanner)
+
 	//output := &bytes.Buffer{}
 	//encoder := json.NewEncoder(output)
 	var messages []*LogMsg
+	var ends []int64 // The offset just past each message, so that we know what each relay has already got
 
-	// TODO: limit the number of lines that we scan in one go, to avoid sending a 100MB dump to loggly.
-	// In order to do that, we'll probably have to use a lower-level scanning mechanism so that we can
-	// get accurate seek positions when we stop.
 	discarded := 0
 	// Unparseable lines
 	extraLines := []byte{}
 	var prev_msg *LogMsg
+	prev_pos := int64(0) // offset (relative to src.lastPos) of the line that produced prev_msg
+	line_end := int64(0)
+	more := false
 	for scanner.Scan() {
+		// A truncated line's skipped tail lies between line_end and line_start
+		line_start := splitter.start
+		line_end = splitter.consumed
+		if splitter.truncated {
+			s.logMetaf("Truncated a line of more than %v bytes at offset %v of %v", splitter.maxLine, src.lastPos+line_start, src.Filename)
+		}
 		// We need to make a copy of scanner.Bytes(), because we store a message for one or more loop
 		// iterations before dumping it to JSON. This does cause unnecessary GC pressure, but I'm leaving
-		// it like this until the scraper becomes a performance hotspot.
-		line := make([]byte, len(scanner.Bytes()))
-		copy(line, scanner.Bytes())
+		// it like this until the scraper becomes a performance hotspot. Decoding gives us that copy.
+		line := enc.decode(scanner.Bytes())
 		msg := src.Parse(line)
 		if msg != nil {
+			msg.Truncated = splitter.truncated
 			if prev_msg != nil {
 				prev_msg.Message = append(prev_msg.Message, extraLines...)
-				prev_msg.toMessageArray(s.Hostname, s.OwnHostname, src.Name, &messages)
+				prev_msg.toMessageArray(s.Hostname, s.OwnHostname, src.Name, src.ParserName, &messages)
+				ends = append(ends, src.lastPos+line_start)
 				//prev_msg.toLogglyJson(s.Hostname, s.OwnHostname, src.Name, encoder)
 			} else {
 				discarded += len(extraLines)
 			}
 			extraLines = []byte{}
 			prev_msg = msg
+			prev_pos = line_start
 		} else {
 			// This might be multi-line message. Save it in a buffer, and append it to the previous message,
 			// as soon as we find a new parseable message. By saving the lines in a buffer, we avoid storing
 			// a half-written message from the end of the file.
 			extraLines = append(extraLines, '\n')
 			extraLines = append(extraLines, line...)
+			if splitter.truncated && prev_msg != nil {
+				prev_msg.Truncated = true
+			}
+		}
+		if budget > 0 && splitter.consumed >= budget && !splitter.skipping {
+			more = true
+			break
 		}
 	}
 	if scanner.Err() != nil {
 		s.logMetaf("Error reading log file %v: %v", src.Filename, scanner.Err())
-		return
+		return false
+	}
+	if !more {
+		// Include the tail of a truncated line that was skipped after the last token
+		line_end = splitter.consumed
+	}
+	if more && prev_msg != nil {
+		// The last message may still have continuation lines that we haven't read yet, so leave it
+		// for the next pass. If it is the only message we have, then it alone is bigger than our
+		// budget, and we send it anyway, so that we're guaranteed to make progress.
+		if prev_pos > 0 {
+			line_end = prev_pos
+			prev_msg = nil
+		} else {
+			prev_msg.Message = append(prev_msg.Message, extraLines...)
+		}
 	}
 	if prev_msg != nil {
-		prev_msg.toMessageArray(s.Hostname, s.OwnHostname, src.Name, &messages)
+		prev_msg.toMessageArray(s.Hostname, s.OwnHostname, src.Name, src.ParserName, &messages)
+		ends = append(ends, src.lastPos+line_end)
 		//prev_msg.toLogglyJson(s.Hostname, s.OwnHostname, src.Name, encoder)
 	}
 	if discarded != 0 {
 		s.logMetaf("Discarded %v unparseable bytes from %v", discarded, src.Filename)
 	}
-	var err error
-	if src.lastPos, err = logFile.Seek(0, os.SEEK_CUR); err != nil {
-		s.logMetaf("Unable to find current file location after scanning %v: %v", src.Filename, err)
-		return
-	}
 
 	fmt.Printf("Scanning %s, messages length = %d\n", src.Filename, len(messages))
-	if len(messages) > 0 {
-		NotifyAllRelayers(messages)
+	start := src.lastPos
+	s.relayMessages(src, messages, ends, src.lastPos+line_end)
+	// If a relay held us back, then reading again straight away would only fetch the same messages
+	return more && src.lastPos > start
+}
+
+/*
+Send each relay the messages that lie beyond its own position in relayPos, and move the relay's
+position to end if it accepts them. src.lastPos becomes the lowest of those positions, so a relay
+that failed is sent the same messages again on the next pass, and the relays that succeeded are
+only sent what comes after. Relays may therefore see duplicates, but no gaps, except where we
+give up on messages that a relay can't take:
+
+	A permanent error (see isPermanent) means that sending the same messages again won't help,
+	so we move past them straight away.
+
+	A relay that has failed for longer than RelayRetryLimit, without making any progress, has
+	its messages skipped too. Otherwise, once the other relays are more than MaxBytesPerPass
+	ahead of it, a relay that is down would hold them back for as long as it stays down.
+
+A relay that returns a partialError has accepted some of the messages, and moves past those.
+A relay that we haven't seen before starts at src.lastPos.
+*/
+func (s *Scraper) relayMessages(src *LogSource, messages []*LogMsg, ends []int64, end int64) {
+	relays := currentRelayers()
+	for name := range src.relayPos {
+		if _, ok := relays[name]; !ok {
+			delete(src.relayPos, name)
+			delete(src.relayFailing, name)
+		}
 	}
+	now := time.Now()
+	low := end
+	for name, relay := range relays {
+		pos, ok := src.relayPos[name]
+		if !ok || pos < src.lastPos {
+			pos = src.lastPos
+		}
+		if pos < end {
+			first := sort.Search(len(ends), func(i int) bool { return ends[i] > pos })
+			var err error
+			if first < len(messages) {
+				err = relay.Send(messages[first:])
+			}
+			var partial partialError
+			if errors.As(err, &partial) && partial.Sent > 0 {
+				pos = ends[first+partial.Sent-1]
+				delete(src.relayFailing, name)
+			}
+			if err == nil {
+				pos = end
+				delete(src.relayFailing, name)
+			} else if isPermanent(err) {
+				s.logMetaf("Relay %v can't take %v messages of %v, so we're skipping them: %v", name, len(messages)-first, src.Filename, err)
+				pos = end
+			} else if since, failing := src.relayFailing[name]; !failing {
+				src.relayFailing[name] = now
+			} else if now.Sub(since) > s.RelayRetryLimit {
+				s.logMetaf("Relay %v has failed for %v, so we're skipping %v messages of %v: %v", name, now.Sub(since).Truncate(time.Second), len(messages)-first, src.Filename, err)
+				pos = end
+				delete(src.relayFailing, name)
+			}
+		}
+		src.relayPos[name] = pos
+		if pos < low {
+			low = pos
+		}
+	}
+	src.lastPos = low
 }
 
 // This runs when we are seeing a fresh log file for the first time
@@ -347,64 +679,204 @@ func (s *Scraper) handleLogRoll(src *LogSource) error {
 	// before it was archived.
 	_, err = orgFile.Seek(src.lastPos, os.SEEK_SET)
 	if err == nil {
-		s.scan(orgFile, src)
+		// We must finish the archive before moving onto the new file, so there is no budget here.
+		// This is our only chance, so a relay that fails now misses the rest of the archive.
+		s.scan(orgFile, src, 0)
 	}
 	orgFile.Close()
 	return err
 }
 
-func (s *Scraper) loadState() {
+func (s *Scraper) openState() {
 	if s.StateFilename == "" {
 		return
 	}
-
-	jraw, err := ioutil.ReadFile(s.StateFilename)
+	state, err := OpenStateStore(s.StateBackend, s.StateFilename, s.logMetaf)
 	if err != nil {
-		s.logMetaf("Unable to read state file %v", err)
+		// Carry on without state, which means that we'll start from scratch on every restart
+		s.logMetaf("Unable to open %v state store %v: %v", s.StateBackend, s.StateFilename, err)
+		return
+	}
+	s.state = state
+}
+
+func (s *Scraper) loadState() {
+	if s.state == nil {
 		return
 	}
 
-	jstate := stateJson{}
-	if err = json.Unmarshal(jraw, &jstate); err != nil {
-		s.logMetaf("Unable to parse state file %v: %v", s.StateFilename, err)
+	saved, err := s.state.Load()
+	if err != nil {
+		s.logMetaf("Unable to load state: %v", err)
 		return
 	}
 
-	for _, src := range s.Sources {
-		if jstateItem, ok := jstate.Sources[src.Filename]; ok {
-			src.firstLine = jstateItem.FirstLine
-			src.lastPos = jstateItem.LastPos
+	s.restoreSources(s.sourceList(), saved)
+	s.collectStateGarbage(saved)
+}
+
+// Restore the state of each of srcs from saved, migrating legacy entries along the way.
+// saved is updated to reflect the migration.
+func (s *Scraper) restoreSources(srcs []*LogSource, saved map[string]SourceState) {
+	byName := make(map[string]string)
+	for key, st := range saved {
+		if st.Name != "" {
+			byName[st.Name] = key
+		}
+	}
+
+	migrated := make(map[string]SourceState)
+	var legacy []string
+	for _, src := range srcs {
+		identity := identifyFile(src.Filename)
+		if st, ok := saved[stateKey(src.Name, identity)]; ok && identity != "" {
+			src.restore(st, stateKey(src.Name, identity))
+		} else if key, ok := byName[src.Name]; ok {
+			// The file has been replaced since we last ran. Restoring the old identity makes
+			// runSource look for the archive of the old file, and finish reading it.
+			src.restore(saved[key], key)
+		} else if key, st, ok := findLegacyState(saved, src.Filename); ok && identity != "" {
+			// Entries from before version 2 are keyed by filename, and we assume that the file is
+			// still the same one.
+			st.Name = src.Name
+			st.Filename = src.Filename
+			st.Identity = identity
+			src.restore(st, stateKey(src.Name, identity))
+			migrated[stateKey(src.Name, identity)] = st
+			legacy = append(legacy, key)
+		}
+	}
+
+	if len(migrated) != 0 {
+		if err := s.state.Commit(migrated, legacy); err != nil {
+			s.logMetaf("Unable to migrate %v state entries: %v", len(legacy), err)
+			for _, src := range srcs {
+				if _, ok := migrated[src.savedKey]; ok {
+					src.savedKey = ""
+					src.markDirty()
+				}
+			}
+		} else {
+			s.logMetaf("Migrated %v state entries to source name and file identity keys", len(legacy))
+			for _, key := range legacy {
+				delete(saved, key)
+			}
+			for key, st := range migrated {
+				saved[key] = st
+			}
+		}
+	}
+}
+
+// Returns the fileIdentity of the file at path, or an empty string if it cannot be opened
+func identifyFile(path string) string {
+	file, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+	return fileIdentity(file)
+}
+
+// Find a legacy (filename-keyed) entry whose filename refers to the same file as path
+func findLegacyState(saved map[string]SourceState, path string) (string, SourceState, bool) {
+	if st, ok := saved[path]; ok && st.Name == "" {
+		return path, st, true
+	}
+	norm := normalizePath(path)
+	for key, st := range saved {
+		if st.Name == "" && normalizePath(key) == norm {
+			return key, st, true
 		}
 	}
+	return "", SourceState{}, false
 }
 
 func (s *Scraper) saveState() {
-	if s.StateFilename == "" {
+	if s.state == nil {
 		return
 	}
 
-	jstate := stateJson{
-		Sources: make(map[string]stateSourceJson),
-	}
-	for _, src := range s.Sources {
-		jstate.Sources[src.Filename] = stateSourceJson{
-			FirstLine: src.firstLine,
-			LastPos:   src.lastPos,
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+
+	put := make(map[string]SourceState)
+	var remove []string
+	dirty := make(map[*LogSource]string)
+	for _, src := range s.sourceList() {
+		st, changed := src.takeSnapshot()
+		if !changed {
+			continue
+		}
+		if st.Identity == "" {
+			// We've never managed to open the file, so there is nothing worth remembering
+			continue
+		}
+		key := stateKey(st.Name, st.Identity)
+		put[key] = st
+		dirty[src] = key
+		if src.savedKey != "" && src.savedKey != key {
+			// The file was rolled, so the entry of the old file is no longer needed
+			remove = append(remove, src.savedKey)
 		}
 	}
-	raw, err := json.MarshalIndent(&jstate, "", "\t")
-	if err != nil {
-		s.logMetaf("Error marshalling state: %v", err)
+	if len(put) == 0 {
 		return
 	}
 
-	err = ioutil.WriteFile(s.StateFilename, raw, 0666)
-	if err != nil {
-		s.logMetaf("Error writing state file: %v", err)
+	if err := s.state.Commit(put, remove); err != nil {
+		s.logMetaf("Error writing state: %v", err)
+		for src := range dirty {
+			src.markDirty()
+		}
+		return
+	}
+	for src, key := range dirty {
+		src.savedKey = key
+	}
+}
+
+// Remove the state of files that no longer belong to any of our sources. Without this, the state
+// of every rolled or retired log would stay around forever. We keep the state of retired sources
+// for as long as their files exist, in case they come back.
+func (s *Scraper) collectStateGarbage(saved map[string]SourceState) {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+
+	s.stateGCTime = time.Now()
+	names := make(map[string]bool)
+	live := make(map[string]bool)
+	for _, src := range s.sourceList() {
+		names[src.Name] = true
+		live[src.savedKey] = true
+	}
+	var stale []string
+	for key, st := range saved {
+		if live[key] {
+			continue
+		}
+		filename := st.Filename
+		if st.Name == "" {
+			filename = key
+		}
+		if names[st.Name] && st.Name != "" {
+			// A leftover from a source whose file has since been rolled
+			stale = append(stale, key)
+		} else if _, err := os.Stat(filename); os.IsNotExist(err) {
+			stale = append(stale, key)
+		}
+	}
+	if len(stale) == 0 {
+		return
+	}
+	if err := s.state.Commit(nil, stale); err != nil {
+		s.logMetaf("Unable to remove %v stale state entries: %v", len(stale), err)
+		return
 	}
+	s.logMetaf("Removed %v stale state entries", len(stale))
 }
 
 func (s *Scraper) logMetaf(msg string, params ...interface{}) {
 	str := time.Now().Format(timeRFC8601_6Digits) + " " + fmt.Sprintf(msg+"\n", params...)
-	s.metaLogFile.Write([]byte(str))
+	s.metaLogFile.Write([]byte(s.secrets.redact(str)))
 }
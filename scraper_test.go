@@ -0,0 +1,75 @@
+package logscraper
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// A relay that answers every Send with err, and records what it was sent
+type fakeRelay struct {
+	err  error
+	sent [][]*LogMsg
+}
+
+func (r *fakeRelay) Send(messages []*LogMsg) error {
+	r.sent = append(r.sent, messages)
+	return r.err
+}
+
+func TestRelayMessages(t *testing.T) {
+	messages := []*LogMsg{{Message: []byte("a")}, {Message: []byte("b")}, {Message: []byte("c")}}
+	ends := []int64{110, 120, 130}
+	failure := errors.New("Connection refused")
+	cases := []struct {
+		name    string
+		err     error
+		pos     int64         // Of the relay before the pass. Zero means it has none.
+		failing time.Duration // How long the relay has been failing before the pass
+		sent    int           // Messages that it is sent
+		end     int64         // Its position after the pass
+	}{
+		{name: "accepted", err: nil, sent: 3, end: 130},
+		{name: "already has some", err: nil, pos: 120, sent: 1, end: 130},
+		{name: "already has them all", err: nil, pos: 130, sent: 0, end: 130},
+		{name: "failed", err: failure, sent: 3, end: 100},
+		{name: "failed after the first", err: partialError{failure, 1}, sent: 3, end: 110},
+		{name: "rejected", err: permanentError{failure}, sent: 3, end: 130},
+		{name: "rejected after the first", err: partialError{permanentError{failure}, 1}, sent: 3, end: 130},
+		{name: "failing for a while", err: failure, failing: time.Minute, sent: 3, end: 100},
+		{name: "failing for too long", err: failure, failing: time.Hour, sent: 3, end: 130},
+	}
+	defer setRelayers(currentRelayers())
+	for _, c := range cases {
+		s := NewScraper("host", "ownhost", "", "")
+		s.RelayRetryLimit = 10 * time.Minute
+		src := NewLogSource("test", "test.log", parsersByName["go"])
+		src.lastPos = 100
+		ok := &fakeRelay{}
+		relay := &fakeRelay{err: c.err}
+		setRelayers(map[string]Relay{"ok": ok, "relay": relay})
+		src.relayPos["ok"] = 130
+		if c.pos != 0 {
+			src.relayPos["relay"] = c.pos
+			src.lastPos = c.pos
+		}
+		if c.failing != 0 {
+			src.relayFailing["relay"] = time.Now().Add(-c.failing)
+		}
+		s.relayMessages(src, messages, ends, 130)
+
+		sent := 0
+		if len(relay.sent) != 0 {
+			sent = len(relay.sent[0])
+		}
+		if sent != c.sent {
+			t.Errorf("%v: sent %v messages, expected %v", c.name, sent, c.sent)
+		}
+		if len(ok.sent) != 0 {
+			t.Errorf("%v: resent %v messages to a relay that already has them", c.name, len(ok.sent[0]))
+		}
+		if src.relayPos["relay"] != c.end || src.lastPos != c.end {
+			t.Errorf("%v: relay is at %v, and the source at %v. Expected %v", c.name, src.relayPos["relay"], src.lastPos, c.end)
+		}
+	}
+}
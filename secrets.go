@@ -0,0 +1,171 @@
+package logscraper
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/*
+Credentials in the relays section of the config should not be written out in plain text.
+Instead, any string in a relay's definition may refer to secrets, which are substituted
+before the relay's factory sees its settings:
+
+	${env:NAME}       The environment variable NAME
+	${file:/path}     The contents of a file, without trailing white space (eg a Docker or Kubernetes secret)
+	${keystore:NAME}  The secret NAME in our encrypted keystore (see Keystore)
+
+Every secret that we resolve is remembered, and scrubbed out of everything that we write to the
+meta log, or return from the admin API.
+*/
+
+const redacted = "[REDACTED]"
+
+// Secrets shorter than this are not redacted, because they would mangle too much innocent text
+const minRedactLength = 4
+
+var secretRefRegex = regexp.MustCompile(`\$\{(env|file|keystore):([^}]*)\}`)
+
+type secretResolver struct {
+	keystoreFile   string
+	machineKeyFile string
+	lock           sync.Mutex
+	keystore       *Keystore       // nil until the first ${keystore:} reference
+	known          map[string]bool // Values to redact
+	replacer       *strings.Replacer
+}
+
+func newSecretResolver(keystoreFile, machineKeyFile string) *secretResolver {
+	return &secretResolver{
+		keystoreFile:   keystoreFile,
+		machineKeyFile: machineKeyFile,
+		known:          make(map[string]bool),
+	}
+}
+
+// Replace all secret references in str with their values
+func (r *secretResolver) resolve(str string) (string, error) {
+	var firstErr error
+	out := secretRefRegex.ReplaceAllStringFunc(str, func(ref string) string {
+		m := secretRefRegex.FindStringSubmatch(ref)
+		value, err := r.lookup(m[1], m[2])
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			return ref
+		}
+		r.track(value)
+		return value
+	})
+	return out, firstErr
+}
+
+func (r *secretResolver) lookup(kind, name string) (string, error) {
+	switch kind {
+	case "env":
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("Environment variable %v is not set", name)
+		}
+		return value, nil
+	case "file":
+		raw, err := os.ReadFile(name)
+		if err != nil {
+			return "", fmt.Errorf("Unable to read secret: %v", err)
+		}
+		return strings.TrimRight(string(raw), " \t\r\n"), nil
+	case "keystore":
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		if r.keystore == nil {
+			ks, err := OpenKeystore(r.keystoreFile, r.machineKeyFile)
+			if err != nil {
+				return "", err
+			}
+			r.keystore = ks
+		}
+		value, ok := r.keystore.Get(name)
+		if !ok {
+			return "", fmt.Errorf("Secret %v is not in the keystore %v", name, r.keystoreFile)
+		}
+		return value, nil
+	}
+	return "", fmt.Errorf("Unknown kind of secret %v", kind)
+}
+
+// Resolve the secret references in all of the strings inside a JSON document
+func (r *secretResolver) resolveJson(raw json.RawMessage) (json.RawMessage, error) {
+	if !secretRefRegex.Match(raw) {
+		return raw, nil
+	}
+	var doc interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	var firstErr error
+	var walk func(v interface{}) interface{}
+	walk = func(v interface{}) interface{} {
+		switch t := v.(type) {
+		case string:
+			resolved, err := r.resolve(t)
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+			return resolved
+		case map[string]interface{}:
+			for k, e := range t {
+				t[k] = walk(e)
+			}
+		case []interface{}:
+			for i, e := range t {
+				t[i] = walk(e)
+			}
+		}
+		return v
+	}
+	doc = walk(doc)
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return json.Marshal(doc)
+}
+
+// Remember a secret that did not come through resolve (eg one read from the Datadog agent's config), so that it gets redacted
+func (r *secretResolver) track(value string) {
+	if len(value) < minRedactLength {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.known[value] {
+		return
+	}
+	r.known[value] = true
+	// Replace longer secrets first, in case one contains another
+	values := make([]string, 0, len(r.known))
+	for v := range r.known {
+		values = append(values, v)
+	}
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	pairs := make([]string, 0, 2*len(values))
+	for _, v := range values {
+		pairs = append(pairs, v, redacted)
+	}
+	r.replacer = strings.NewReplacer(pairs...)
+}
+
+// Scrub all known secrets out of str
+func (r *secretResolver) redact(str string) string {
+	r.lock.Lock()
+	replacer := r.replacer
+	r.lock.Unlock()
+	if replacer == nil {
+		return str
+	}
+	return replacer.Replace(str)
+}
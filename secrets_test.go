@@ -0,0 +1,136 @@
+package logscraper
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestSecretResolver(t *testing.T) *secretResolver {
+	dir := t.TempDir()
+	r := newSecretResolver(filepath.Join(dir, "keystore"), filepath.Join(dir, "machinekey"))
+	ks, err := OpenKeystore(r.keystoreFile, r.machineKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks.Set("API_KEY", "keystore-secret")
+	if err := ks.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "token"), []byte("file-secret \r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("LOGSCRAPER_TEST_SECRET", "env-secret")
+	t.Cleanup(func() { os.Unsetenv("LOGSCRAPER_TEST_SECRET") })
+	return r
+}
+
+func TestSecretResolve(t *testing.T) {
+	r := newTestSecretResolver(t)
+	dir := filepath.Dir(r.keystoreFile)
+	cases := []struct {
+		str      string
+		expected string
+		fail     bool
+	}{
+		{str: "plain", expected: "plain"},
+		{str: "${env:LOGSCRAPER_TEST_SECRET}", expected: "env-secret"},
+		{str: "${file:" + filepath.Join(dir, "token") + "}", expected: "file-secret"},
+		{str: "${keystore:API_KEY}", expected: "keystore-secret"},
+		{str: "Bearer ${env:LOGSCRAPER_TEST_SECRET} and ${keystore:API_KEY}!", expected: "Bearer env-secret and keystore-secret!"},
+		{str: "${vault:API_KEY}", expected: "${vault:API_KEY}"}, // Not a kind that we know, so not a reference
+		{str: "${env:LOGSCRAPER_TEST_UNSET}", fail: true},
+		{str: "${file:" + filepath.Join(dir, "missing") + "}", fail: true},
+		{str: "${keystore:MISSING}", fail: true},
+		{str: "${env:LOGSCRAPER_TEST_SECRET} ${keystore:MISSING}", fail: true},
+	}
+	for _, c := range cases {
+		resolved, err := r.resolve(c.str)
+		if c.fail {
+			if err == nil {
+				t.Errorf("%v: expected an error, but resolved to %v", c.str, resolved)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", c.str, err)
+		} else if resolved != c.expected {
+			t.Errorf("%v: resolved to %v, expected %v", c.str, resolved, c.expected)
+		}
+	}
+}
+
+func TestSecretResolveJson(t *testing.T) {
+	r := newTestSecretResolver(t)
+	raw, err := r.resolveJson(json.RawMessage(`{"url": "https://x", "auth": {"token": "${keystore:API_KEY}"}, "headers": ["${env:LOGSCRAPER_TEST_SECRET}"], "n": 1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"auth":{"token":"keystore-secret"},"headers":["env-secret"],"n":1,"url":"https://x"}`
+	if string(raw) != expected {
+		t.Errorf("Resolved to %s, expected %s", raw, expected)
+	}
+	if _, err := r.resolveJson(json.RawMessage(`{"token": "${keystore:MISSING}"}`)); err == nil {
+		t.Error("Expected an unresolved reference to fail")
+	}
+}
+
+func TestSecretRedact(t *testing.T) {
+	r := newTestSecretResolver(t)
+	if _, err := r.resolve("${env:LOGSCRAPER_TEST_SECRET} ${keystore:API_KEY}"); err != nil {
+		t.Fatal(err)
+	}
+	r.track("abc")                    // Too short to redact
+	r.track("keystore-secret-longer") // Contains another secret, so it must be replaced first
+	cases := []struct {
+		str      string
+		expected string
+	}{
+		{"nothing to hide", "nothing to hide"},
+		{"key=keystore-secret", "key=" + redacted},
+		{"env-secret/env-secret", redacted + "/" + redacted},
+		{"keystore-secret-longer", redacted},
+		{"abc", "abc"},
+		{"${keystore:API_KEY}", "${keystore:API_KEY}"},
+	}
+	for _, c := range cases {
+		if redactedStr := r.redact(c.str); redactedStr != c.expected {
+			t.Errorf("redact(%q) = %q, expected %q", c.str, redactedStr, c.expected)
+		}
+	}
+}
+
+// Secrets must not leak through the meta log or the admin API
+func TestSecretRedactOutput(t *testing.T) {
+	s := NewScraper("host", "ownhost", "", "")
+	s.secrets = newTestSecretResolver(t)
+	if _, err := s.secrets.resolve("${keystore:API_KEY}"); err != nil {
+		t.Fatal(err)
+	}
+
+	var metaLog bytes.Buffer
+	s.metaLogFile = &metaLog
+	s.logMetaf("Error posting to https://example.com/?key=%v", "keystore-secret")
+	if strings.Contains(metaLog.String(), "keystore-secret") || !strings.Contains(metaLog.String(), redacted) {
+		t.Errorf("Meta log has %q", metaLog.String())
+	}
+
+	s.setSources([]*LogSource{NewLogSource("app", "/logs/keystore-secret.log", parsersByName["go"])})
+	server := httptest.NewServer(s.adminHandler())
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if strings.Contains(string(raw), "keystore-secret") || !strings.Contains(string(raw), redacted) {
+		t.Errorf("Admin API status has %s", raw)
+	}
+}
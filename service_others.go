@@ -2,6 +2,8 @@
 
 package logscraper
 
-func RunAsService(handler func()) bool {
+import "context"
+
+func RunAsService(handler func(ctx context.Context), ctl Controller) bool {
 	return false
 }
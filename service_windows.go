@@ -1,19 +1,27 @@
 package logscraper
 
 import (
+	"context"
 	"golang.org/x/sys/windows/svc"
 	"log"
 )
 
 type myservice struct {
-	handler func()
+	handler func(ctx context.Context)
+	ctl     Controller
 }
 
 func (m *myservice) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (ssec bool, errno uint32) {
-	const cmdsAccepted = svc.AcceptStop | svc.AcceptShutdown | svc.AcceptPauseAndContinue
+	const cmdsAccepted = svc.AcceptStop | svc.AcceptShutdown | svc.AcceptPauseAndContinue | svc.AcceptParamChange
 	changes <- svc.Status{State: svc.StartPending}
 	changes <- svc.Status{State: svc.Running, Accepts: cmdsAccepted}
-	go m.handler()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		m.handler(ctx)
+		close(done)
+	}()
 loop:
 	for {
 		select {
@@ -24,21 +32,36 @@ loop:
 			case svc.Stop, svc.Shutdown:
 				break loop
 			case svc.Pause:
+				changes <- svc.Status{State: svc.PausePending, Accepts: cmdsAccepted}
+				m.ctl.Pause()
 				changes <- svc.Status{State: svc.Paused, Accepts: cmdsAccepted}
 			case svc.Continue:
+				changes <- svc.Status{State: svc.ContinuePending, Accepts: cmdsAccepted}
+				m.ctl.Resume()
 				changes <- svc.Status{State: svc.Running, Accepts: cmdsAccepted}
+			case svc.ParamChange:
+				m.ctl.Reload()
+				changes <- c.CurrentStatus
 			default:
 				//elog.Error(1, fmt.Sprintf("unexpected control request #%d", c))
 			}
+		case <-done:
+			// The handler gave up by itself
+			break loop
 		}
 	}
 	changes <- svc.Status{State: svc.StopPending}
+	// Tell the handler to stop, and give it the chance to save its state. The handler
+	// is responsible for respecting its own shutdown deadline.
+	cancel()
+	<-done
 	return
 }
 
 // Returns true if we detected that we are not running in a non-interactive session, and so
 // launched the service. This function will not return until the service exits.
-func RunAsService(handler func()) bool {
+// Pause, Continue and ParamChange requests from the service manager are passed on to ctl.
+func RunAsService(handler func(ctx context.Context), ctl Controller) bool {
 	interactive, err := svc.IsAnInteractiveSession()
 	if err != nil {
 		log.Fatalf("failed to determine if we are running in an interactive session: %v", err)
@@ -51,6 +74,7 @@ func RunAsService(handler func()) bool {
 	serviceName := "" // this doesn't matter when we are a "single-process" service
 	service := &myservice{
 		handler: handler,
+		ctl:     ctl,
 	}
 	svc.Run(serviceName, service)
 	return true
@@ -0,0 +1,105 @@
+package logscraper
+
+import (
+	"bytes"
+	"strconv"
+)
+
+// Level is a severity that means the same thing regardless of the format of the log that it
+// came from. Each log format spells its severities differently (I, INFO, info, Information),
+// and relays that have a notion of severity map Level onto their own.
+type Level int
+
+const (
+	LevelUnknown Level = iota
+	LevelTrace
+	LevelDebug
+	LevelInfo
+	LevelWarning
+	LevelError
+	LevelFatal
+)
+
+var levelNames = map[Level]string{
+	LevelUnknown: "",
+	LevelTrace:   "trace",
+	LevelDebug:   "debug",
+	LevelInfo:    "info",
+	LevelWarning: "warning",
+	LevelError:   "error",
+	LevelFatal:   "fatal",
+}
+
+var levelsBySeverity = map[string]Level{
+	"T":           LevelTrace,
+	"TRACE":       LevelTrace,
+	"FINEST":      LevelTrace,
+	"FINER":       LevelTrace,
+	"D":           LevelDebug,
+	"DEBUG":       LevelDebug,
+	"DBG":         LevelDebug,
+	"FINE":        LevelDebug,
+	"I":           LevelInfo,
+	"INFO":        LevelInfo,
+	"INFORMATION": LevelInfo,
+	"NOTICE":      LevelInfo,
+	"CONFIG":      LevelInfo,
+	"W":           LevelWarning,
+	"WARN":        LevelWarning,
+	"WARNING":     LevelWarning,
+	"E":           LevelError,
+	"ERR":         LevelError,
+	"ERROR":       LevelError,
+	"SEVERE":      LevelError,
+	"F":           LevelFatal,
+	"FATAL":       LevelFatal,
+	"C":           LevelFatal,
+	"CRIT":        LevelFatal,
+	"CRITICAL":    LevelFatal,
+	"PANIC":       LevelFatal,
+	"ALERT":       LevelFatal,
+	"EMERG":       LevelFatal,
+}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// Returns the Level of a severity as it appears in a log, or LevelUnknown if we don't recognise it
+func ParseLevel(severity []byte) Level {
+	return levelsBySeverity[string(bytes.ToUpper(bytes.TrimSpace(severity)))]
+}
+
+// Returns the normalized severity of the message. Messages without a severity of their own
+// (eg router logs) get theirs from the HTTP response code.
+func (m *LogMsg) Level() Level {
+	if len(m.Severity) != 0 {
+		return ParseLevel(m.Severity)
+	}
+	if code, err := strconv.Atoi(string(m.ResponseCode)); err == nil {
+		switch {
+		case code >= 500:
+			return LevelError
+		case code >= 400:
+			return LevelWarning
+		default:
+			return LevelInfo
+		}
+	}
+	return LevelUnknown
+}
+
+// Returns the syslog severity (RFC 5424) of the level. Unknown levels count as informational.
+func (l Level) Syslog() int {
+	switch l {
+	case LevelFatal:
+		return 2 // Critical
+	case LevelError:
+		return 3
+	case LevelWarning:
+		return 4
+	case LevelDebug, LevelTrace:
+		return 7
+	}
+	return 6 // Informational
+}
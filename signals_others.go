@@ -0,0 +1,34 @@
+// +build !windows
+
+package logscraper
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Pause on SIGUSR1, resume on SIGUSR2, and reload the configuration on SIGHUP, until ctx is cancelled
+func HandleControlSignals(ctx context.Context, ctl Controller) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(ch)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case sig := <-ch:
+				switch sig {
+				case syscall.SIGUSR1:
+					ctl.Pause()
+				case syscall.SIGUSR2:
+					ctl.Resume()
+				case syscall.SIGHUP:
+					ctl.Reload()
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,7 @@
+package logscraper
+
+import "context"
+
+// Windows has no equivalent of SIGUSR1/SIGUSR2. Use the service manager, or the admin API.
+func HandleControlSignals(ctx context.Context, ctl Controller) {
+}
@@ -0,0 +1,307 @@
+package logscraper
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+/*
+SplunkRelay sends messages to a Splunk HTTP Event Collector (HEC), as batches of events.
+Each event's source is the name of its log source, its sourcetype is the name of its parser,
+and its host is the scraper's Hostname.
+
+If the HEC token has indexer acknowledgement enabled, then set useAck. Every batch then comes
+back with an ack ID, and Send doesn't return until Splunk confirms that all of the batches have
+been indexed, and fails if that takes longer than AckTimeout, or if the scraper shuts down in
+the meantime. relayMessages only moves the relay's position past messages once Send succeeds,
+and sends them again on the next pass if it fails, so this gives us end-to-end delivery
+confirmation: anything that Splunk doesn't confirm is sent again, possibly more than once.
+*/
+
+const (
+	splunkEventPath     = "/services/collector/event"
+	splunkAckPath       = "/services/collector/ack"
+	splunkMaxBatchBytes = 1024 * 1024
+	splunkTimeout       = 30 * time.Second
+)
+
+type SplunkRelay struct {
+	s               *Scraper
+	URL             string // The base URL, eg https://splunk:8088
+	Token           string
+	Index           string // Empty means the token's default index
+	SourceType      string // Overrides the parser name, if not empty
+	UseAck          bool
+	Channel         string // Identifies us to the acknowledgement API
+	AckTimeout      time.Duration
+	AckPollInterval time.Duration
+	client          *http.Client
+}
+
+type splunkEvent struct {
+	Time       float64          `json:"time"` // Seconds since the epoch
+	Host       string           `json:"host,omitempty"`
+	Source     string           `json:"source,omitempty"`
+	SourceType string           `json:"sourcetype,omitempty"`
+	Index      string           `json:"index,omitempty"`
+	Event      splunkEventValue `json:"event"`
+}
+
+type splunkEventValue struct {
+	Message          string `json:"message"`
+	Level            string `json:"level,omitempty"`    // Normalized, see Level
+	Severity         string `json:"severity,omitempty"` // As it appears in the log
+	OwnHostname      string `json:"ownhostname,omitempty"`
+	ProcessID        string `json:"process_id,omitempty"`
+	ThreadID         string `json:"thread_id,omitempty"`
+	ClientIP         string `json:"client_ip,omitempty"`
+	Request          string `json:"request,omitempty"`
+	ResponseCode     string `json:"response_code,omitempty"`
+	ResponseBytes    string `json:"response_bytes,omitempty"`
+	ResponseDuration string `json:"response_duration,omitempty"`
+	JavaClass        string `json:"java_class,omitempty"`
+	Truncated        bool   `json:"truncated,omitempty"`
+}
+
+type splunkResponse struct {
+	Text  string `json:"text"`
+	Code  int    `json:"code"`
+	AckID *int64 `json:"ackId"`
+}
+
+func newSplunkRelay(s *Scraper, cfg *RelayConfig) (Relay, error) {
+	opt := struct {
+		URL                string `json:"url"`
+		Token              string `json:"token"`
+		Index              string `json:"index"`
+		SourceType         string `json:"sourcetype"`
+		UseAck             bool   `json:"useAck"`
+		Channel            string `json:"channel"`
+		AckTimeoutSeconds  int    `json:"ackTimeoutSeconds"`
+		TimeoutSeconds     int    `json:"timeoutSeconds"` // Of each request
+		InsecureSkipVerify bool   `json:"insecureSkipVerify"`
+	}{
+		AckTimeoutSeconds: 120,
+		TimeoutSeconds:    int(splunkTimeout / time.Second),
+	}
+	if err := cfg.Decode(&opt); err != nil {
+		return nil, err
+	}
+	if opt.URL == "" {
+		return nil, errors.New("No Splunk HEC URL specified")
+	}
+	if _, err := url.Parse(opt.URL); err != nil {
+		return nil, fmt.Errorf("Invalid Splunk HEC URL: %v", err)
+	}
+	if opt.Token == "" {
+		return nil, errors.New("No Splunk HEC token specified")
+	}
+	if opt.TimeoutSeconds <= 0 {
+		return nil, fmt.Errorf("Invalid Splunk timeoutSeconds %v", opt.TimeoutSeconds)
+	}
+	if opt.AckTimeoutSeconds <= 0 {
+		return nil, fmt.Errorf("Invalid Splunk ackTimeoutSeconds %v", opt.AckTimeoutSeconds)
+	}
+	sr := &SplunkRelay{
+		s:               s,
+		URL:             strings.TrimRight(opt.URL, "/"),
+		Token:           opt.Token,
+		Index:           opt.Index,
+		SourceType:      opt.SourceType,
+		UseAck:          opt.UseAck,
+		Channel:         opt.Channel,
+		AckTimeout:      time.Duration(opt.AckTimeoutSeconds) * time.Second,
+		AckPollInterval: time.Second,
+	}
+	if sr.UseAck && sr.Channel == "" {
+		channel, err := newChannelID()
+		if err != nil {
+			return nil, err
+		}
+		sr.Channel = channel
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if opt.InsecureSkipVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	sr.client = &http.Client{Transport: transport, Timeout: time.Duration(opt.TimeoutSeconds) * time.Second}
+	return sr, nil
+}
+
+// Returns a random UUID, which is what HEC expects as a channel
+func newChannelID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+func (sr *SplunkRelay) Send(messages []*LogMsg) error {
+	var acks []int64
+	batch := &bytes.Buffer{}
+	flush := func() error {
+		if batch.Len() == 0 {
+			return nil
+		}
+		ackID, err := sr.post(batch.Bytes())
+		batch.Reset()
+		if err != nil {
+			return err
+		}
+		if sr.UseAck {
+			if ackID == nil {
+				return errors.New("Splunk did not return an ackId. Is indexer acknowledgement enabled for the token?")
+			}
+			acks = append(acks, *ackID)
+		}
+		return nil
+	}
+	for _, m := range messages {
+		raw, err := json.Marshal(sr.event(m))
+		if err != nil {
+			sr.s.logMetaf("Unable to encode message for Splunk: %v", err)
+			continue
+		}
+		if batch.Len() != 0 && batch.Len()+len(raw) > splunkMaxBatchBytes {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		batch.Write(raw)
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	if len(acks) == 0 {
+		return nil
+	}
+	return sr.waitForAcks(acks)
+}
+
+func (sr *SplunkRelay) event(m *LogMsg) *splunkEvent {
+	sourceType := sr.SourceType
+	if sourceType == "" {
+		sourceType = string(m.Format)
+	}
+	return &splunkEvent{
+		Time:       float64(m.Time.UnixNano()) / 1e9,
+		Host:       string(m.Host),
+		Source:     string(m.Source),
+		SourceType: sourceType,
+		Index:      sr.Index,
+		Event: splunkEventValue{
+			Message:          string(m.Message),
+			Level:            m.Level().String(),
+			Severity:         string(m.Severity),
+			OwnHostname:      string(m.OwnHostname),
+			ProcessID:        string(m.ProcessID),
+			ThreadID:         string(m.ThreadID),
+			ClientIP:         string(m.ClientIP),
+			Request:          string(m.Request),
+			ResponseCode:     string(m.ResponseCode),
+			ResponseBytes:    string(m.ResponseBytes),
+			ResponseDuration: string(m.ResponseDuration),
+			JavaClass:        string(m.JavaClass),
+			Truncated:        m.Truncated,
+		},
+	}
+}
+
+// Post a batch of events, and return its ack ID, if there is one
+func (sr *SplunkRelay) post(body []byte) (*int64, error) {
+	var result splunkResponse
+	if err := sr.call(splunkEventPath, body, &result); err != nil {
+		sr.s.logMetaf("Error sending to Splunk: %v", err)
+		return nil, err
+	}
+	return result.AckID, nil
+}
+
+// Poll the acknowledgement API until all of the acks are confirmed, or we time out. We give up
+// straight away if the scraper is shutting down, so that we don't hold it up for AckTimeout.
+func (sr *SplunkRelay) waitForAcks(acks []int64) error {
+	pending := make(map[int64]bool, len(acks))
+	for _, id := range acks {
+		pending[id] = true
+	}
+	deadline := time.Now().Add(sr.AckTimeout)
+	ticker := time.NewTicker(sr.AckPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sr.s.stopping:
+			return fmt.Errorf("Shutting down before Splunk acknowledged %v of %v batches", len(pending), len(acks))
+		case <-ticker.C:
+		}
+		ids := make([]int64, 0, len(pending))
+		for id := range pending {
+			ids = append(ids, id)
+		}
+		body, _ := json.Marshal(map[string][]int64{"acks": ids})
+		var result struct {
+			Acks map[string]bool `json:"acks"`
+		}
+		if err := sr.call(splunkAckPath+"?channel="+url.QueryEscape(sr.Channel), body, &result); err != nil {
+			sr.s.logMetaf("Error polling Splunk for acknowledgements: %v", err)
+		} else {
+			for _, id := range ids {
+				if result.Acks[fmt.Sprint(id)] {
+					delete(pending, id)
+				}
+			}
+			if len(pending) == 0 {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			err := fmt.Errorf("Splunk did not acknowledge %v of %v batches within %v", len(pending), len(acks), sr.AckTimeout)
+			sr.s.logMetaf("%v", err)
+			return err
+		}
+	}
+}
+
+// Post body to the HEC, and decode its response into result
+func (sr *SplunkRelay) call(path string, body []byte, result interface{}) error {
+	req, err := http.NewRequest("POST", sr.URL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Splunk "+sr.Token)
+	if sr.Channel != "" {
+		req.Header.Set("X-Splunk-Request-Channel", sr.Channel)
+	}
+	resp, err := sr.client.Do(req)
+	if err != nil {
+		return err
+	}
+	raw, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if err := checkResponse(resp); err != nil {
+		// The HEC explains itself, eg {"text":"Invalid token","code":4}
+		var reason splunkResponse
+		if json.Unmarshal(raw, &reason) == nil && reason.Text != "" {
+			if isPermanent(err) {
+				return permanentError{fmt.Errorf("%v: %v", err, reason.Text)}
+			}
+			return fmt.Errorf("%v: %v", err, reason.Text)
+		}
+		return err
+	}
+	return json.Unmarshal(raw, result)
+}
@@ -0,0 +1,64 @@
+package logscraper
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplunkRelaySettings(t *testing.T) {
+	cases := []struct {
+		def  string
+		fail bool
+	}{
+		{def: `"url": "https://splunk:8088", "token": "t"`},
+		{def: `"url": "https://splunk:8088", "token": "t", "useAck": true, "ackTimeoutSeconds": 10`},
+		{def: `"url": "https://splunk:8088", "token": "t", "useAck": true, "ackTimeoutSeconds": 0`, fail: true},
+		{def: `"url": "https://splunk:8088", "token": "t", "timeoutSeconds": -1`, fail: true},
+		{def: `"url": "https://splunk:8088"`, fail: true},
+		{def: `"token": "t"`, fail: true},
+	}
+	s := NewScraper("host", "ownhost", "", "")
+	for _, c := range cases {
+		var cfg RelayConfig
+		if err := json.Unmarshal([]byte(`{"name": "splunk", "type": "splunk", `+c.def+`}`), &cfg); err != nil {
+			t.Fatal(err)
+		}
+		_, err := s.newRelay(&cfg)
+		if c.fail && err == nil {
+			t.Errorf("%v: expected an error", c.def)
+		} else if !c.fail && err != nil {
+			t.Errorf("%v: %v", c.def, err)
+		}
+	}
+}
+
+// Waiting for acknowledgements must not hold up a shutdown
+func TestSplunkAckWaitStopsOnShutdown(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, splunkAckPath) {
+			w.Write([]byte(`{"acks": {}}`))
+		} else {
+			w.Write([]byte(`{"text": "Success", "code": 0, "ackId": 1}`))
+		}
+	}))
+	defer server.Close()
+	s := NewScraper("host", "ownhost", "", "")
+	relay := newTestRelay(t, s, `{"name": "splunk", "type": "splunk", "url": "`+server.URL+`", "token": "t", "useAck": true}`)
+	relay.(*SplunkRelay).AckPollInterval = 10 * time.Millisecond
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		close(s.stopping)
+	}()
+	start := time.Now()
+	if err := relay.Send([]*LogMsg{{Message: []byte("one")}}); err == nil {
+		t.Error("Send succeeded without an acknowledgement")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Send took %v to notice the shutdown", elapsed)
+	}
+}
@@ -0,0 +1,206 @@
+package logscraper
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+A start policy decides where we start reading a file that we have no saved state for. This
+happens when a source is new, and also when our state has been lost or reset. Without it,
+onboarding a host with gigabytes of historical logs would flood every relay.
+
+	beginning         Read the whole file (the default)
+	end               Only read messages written from now on
+	since 36h         Start at the first message that is no older than the given duration
+	since 2019-05-01  Start at the first message at or after the given time (RFC 3339 or a date)
+
+For "since", we binary search the file for the first message at or after the cutoff. This
+assumes that the timestamps in the file are (roughly) ascending, which is true of all of our
+log formats.
+
+The policy never applies to a file that replaces one we were already reading (ie a rolled
+log). We always read those from the beginning.
+*/
+
+type startPolicyKind int
+
+const (
+	startBeginning startPolicyKind = iota
+	startEnd
+	startSince
+)
+
+type startPolicy struct {
+	kind  startPolicyKind
+	age   time.Duration // For "since <duration>"
+	since time.Time     // For "since <time>"
+}
+
+// Once the binary search has narrowed things down to this many bytes, we scan linearly
+const startSearchLinearBytes = 16 * 1024
+
+// The most that we'll read from any probe point while looking for a parseable message
+const startSearchProbeBytes = 1024 * 1024
+
+func parseStartPolicy(str string) (startPolicy, error) {
+	str = strings.TrimSpace(str)
+	switch strings.ToLower(str) {
+	case "", "beginning":
+		return startPolicy{kind: startBeginning}, nil
+	case "end":
+		return startPolicy{kind: startEnd}, nil
+	}
+	fields := strings.Fields(str)
+	if len(fields) != 2 || strings.ToLower(fields[0]) != "since" {
+		return startPolicy{}, fmt.Errorf("Invalid start position '%v'. Expected beginning, end, or since <duration|time>", str)
+	}
+	if age, err := parseDays(fields[1]); err == nil {
+		return startPolicy{kind: startSince, age: age}, nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02"} {
+		if since, err := time.ParseInLocation(layout, fields[1], time.Local); err == nil {
+			return startPolicy{kind: startSince, since: since}, nil
+		}
+	}
+	return startPolicy{}, fmt.Errorf("Invalid start position '%v'. '%v' is neither a duration nor a time", str, fields[1])
+}
+
+// Like time.ParseDuration, but also understands a whole number of days, such as "7d"
+func parseDays(str string) (time.Duration, error) {
+	if strings.HasSuffix(str, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(str, "d"))
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(str)
+}
+
+func (p startPolicy) String() string {
+	switch p.kind {
+	case startEnd:
+		return "end"
+	case startSince:
+		if p.age != 0 {
+			return "since " + p.age.String()
+		}
+		return "since " + p.since.Format(time.RFC3339)
+	}
+	return "beginning"
+}
+
+// Returns the position at which to start reading a file that we have no state for
+func (s *Scraper) startPosition(file *os.File, src *LogSource, fileLength int64) (int64, error) {
+	switch src.StartPolicy.kind {
+	case startEnd:
+		return s.lastLineEnd(file, src, fileLength)
+	case startSince:
+		since := src.StartPolicy.since
+		if src.StartPolicy.age != 0 {
+			since = time.Now().Add(-src.StartPolicy.age)
+		}
+		return s.findTime(file, src, fileLength, since)
+	}
+	return 0, nil
+}
+
+// Returns the position just after the last complete line in the file, so that we don't
+// start in the middle of a line that is still being written.
+func (s *Scraper) lastLineEnd(file *os.File, src *LogSource, fileLength int64) (int64, error) {
+	enc, bomLen := src.detectEncoding(file)
+	start := fileLength - startSearchLinearBytes
+	if start < int64(bomLen) {
+		start = int64(bomLen)
+	}
+	start -= (start - int64(bomLen)) % int64(enc.unit)
+	tail := make([]byte, fileLength-start)
+	if _, err := file.ReadAt(tail, start); err != nil && err != io.EOF {
+		return 0, err
+	}
+	for i := len(tail) - len(enc.newline); i >= 0; i-- {
+		if (i%enc.unit) == 0 && bytes.Equal(tail[i:i+len(enc.newline)], enc.newline) {
+			return start + int64(i+len(enc.newline)), nil
+		}
+	}
+	// No complete line in the tail. Either the file is empty, or it has one giant line.
+	return start, nil
+}
+
+// Returns the position of the first message whose time is not before since, or the end of the
+// last complete line if there is no such message.
+func (s *Scraper) findTime(file *os.File, src *LogSource, fileLength int64, since time.Time) (int64, error) {
+	enc, bomLen := src.detectEncoding(file)
+	lo := int64(bomLen)
+	hi := fileLength
+
+	// Invariant: the message that we're looking for starts at or after lo, and no later than hi
+	for hi-lo > startSearchLinearBytes {
+		mid := lo + (hi-lo)/2
+		mid -= (mid - int64(bomLen)) % int64(enc.unit)
+		found := false
+		s.scanTimes(file, src, enc, mid, false, hi, func(p int64, t time.Time) bool {
+			found = true
+			if t.Before(since) {
+				lo = p
+			} else {
+				hi = p
+			}
+			return false
+		})
+		if !found {
+			// Nothing parseable between mid and hi
+			hi = mid
+		}
+	}
+
+	result := int64(-1)
+	err := s.scanTimes(file, src, enc, lo, true, fileLength, func(p int64, t time.Time) bool {
+		if !t.Before(since) {
+			result = p
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	if result < 0 {
+		return s.lastLineEnd(file, src, fileLength)
+	}
+	return result, nil
+}
+
+// Call fn with the position and time of every message that starts between from and to, until fn
+// returns false. If atLine is false, then from may be in the middle of a line, and we skip ahead
+// to the next line. We give up after startSearchProbeBytes if we find nothing parseable.
+func (s *Scraper) scanTimes(file *os.File, src *LogSource, enc *textEncoding, from int64, atLine bool, to int64, fn func(pos int64, t time.Time) bool) error {
+	scanner := bufio.NewScanner(io.NewSectionReader(file, from, to-from))
+	splitter := newLineSplitter(s.maxLineSize(src), enc)
+	splitter.attach(scanner)
+	parsed := false
+	for scanner.Scan() {
+		lineStart := splitter.start
+		lineEnd := splitter.consumed
+		if !atLine {
+			atLine = true
+			continue
+		}
+		if msg := src.Parse(enc.decode(scanner.Bytes())); msg != nil {
+			parsed = true
+			if !fn(from+lineStart, msg.Time) {
+				return nil
+			}
+		} else if !parsed && lineEnd > startSearchProbeBytes {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
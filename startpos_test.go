@@ -0,0 +1,209 @@
+package logscraper
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var startTestBase = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Build a log with one message for each entry of seconds, at that many seconds after
+// startTestBase. A negative entry is a line that doesn't parse, such as part of a stack trace.
+// Returns the log, and the offset at which each line starts.
+func makeStartLog(seconds []int, pad int) (string, []int64) {
+	var b strings.Builder
+	starts := make([]int64, len(seconds))
+	for i, sec := range seconds {
+		starts[i] = int64(b.Len())
+		if sec < 0 {
+			b.WriteString("\tat com.example.Thing.run(Thing.java:42)\n")
+			continue
+		}
+		t := startTestBase.Add(time.Duration(sec) * time.Second)
+		b.WriteString(t.Format(timeRFC8601_6Digits) + " [I] message " + strings.Repeat("x", pad) + "\n")
+	}
+	return b.String(), starts
+}
+
+func openStartLog(t *testing.T, content string) *os.File {
+	filename := filepath.Join(t.TempDir(), "test.log")
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { file.Close() })
+	return file
+}
+
+func seconds(n int, fn func(i int) int) []int {
+	s := make([]int, n)
+	for i := range s {
+		s[i] = fn(i)
+	}
+	return s
+}
+
+func TestFindTime(t *testing.T) {
+	// All of these are well over startSearchLinearBytes, so that the binary search runs
+	ascending := seconds(2000, func(i int) int { return i })
+	cases := []struct {
+		name    string
+		seconds []int
+		pad     int
+		maxLine int // Of the source
+		since   int
+		line    int // That we expect to start at. len(seconds) is the end of the file.
+	}{
+		{name: "ascending", seconds: ascending, since: 1234, line: 1234},
+		{name: "ascending, before the first", seconds: ascending, since: -10, line: 0},
+		{name: "ascending, after the last", seconds: ascending, since: 5000, line: 2000},
+		{name: "ascending, between messages", seconds: seconds(2000, func(i int) int { return i * 2 }), since: 1001, line: 501},
+		{name: "all equal, at that time", seconds: seconds(2000, func(i int) int { return 7 }), since: 7, line: 0},
+		{name: "all equal, after that time", seconds: seconds(2000, func(i int) int { return 7 }), since: 8, line: 2000},
+		{name: "runs of equal times", seconds: seconds(2000, func(i int) int { return i / 300 }), since: 4, line: 1200},
+		{name: "long runs of equal times", seconds: seconds(2000, func(i int) int { return i / 1000 }), since: 1, line: 1000},
+		{
+			name:    "unparseable lines",
+			seconds: seconds(3000, func(i int) int { return map[bool]int{true: -1, false: i}[i%3 != 0] }),
+			since:   1500,
+			line:    1500,
+		},
+		{
+			name:    "truncated lines",
+			seconds: ascending,
+			pad:     200,
+			maxLine: 64,
+			since:   1500,
+			line:    1500,
+		},
+	}
+	for _, c := range cases {
+		content, starts := makeStartLog(c.seconds, c.pad)
+		file := openStartLog(t, content)
+		s := NewScraper("host", "ownhost", "", "")
+		src := NewLogSource("test", file.Name(), parsersByName["go"])
+		src.MaxLineSize = c.maxLine
+		pos, err := s.findTime(file, src, int64(len(content)), startTestBase.Add(time.Duration(c.since)*time.Second))
+		if err != nil {
+			t.Errorf("%v: %v", c.name, err)
+			continue
+		}
+		expected := int64(len(content))
+		if c.line < len(starts) {
+			expected = starts[c.line]
+		}
+		if pos != expected {
+			t.Errorf("%v: started at %v, expected %v (line %v)", c.name, pos, expected, c.line)
+		}
+	}
+}
+
+// When the times are not sorted, we can't promise to find the first message at or after the
+// cutoff, but we must still start at a message that is, or at the end of the file
+func TestFindTimeUnsorted(t *testing.T) {
+	cases := []struct {
+		name    string
+		seconds []int
+	}{
+		{"descending", seconds(2000, func(i int) int { return 2000 - i })},
+		{"shuffled", seconds(2000, func(i int) int { return (i * 7919) % 2000 })},
+		{"one out of order", seconds(2000, func(i int) int { return map[bool]int{true: 0, false: i}[i == 1000] })},
+		{"sawtooth", seconds(2000, func(i int) int { return i % 500 })},
+	}
+	for _, c := range cases {
+		content, starts := makeStartLog(c.seconds, 0)
+		file := openStartLog(t, content)
+		s := NewScraper("host", "ownhost", "", "")
+		src := NewLogSource("test", file.Name(), parsersByName["go"])
+		for _, since := range []int{-1, 1, 250, 999, 1000, 1999, 2000, 3000} {
+			pos, err := s.findTime(file, src, int64(len(content)), startTestBase.Add(time.Duration(since)*time.Second))
+			if err != nil {
+				t.Errorf("%v, since %v: %v", c.name, since, err)
+				continue
+			}
+			if pos == int64(len(content)) {
+				continue
+			}
+			line := -1
+			for i, start := range starts {
+				if start == pos {
+					line = i
+				}
+			}
+			if line < 0 {
+				t.Errorf("%v, since %v: started at %v, which is not the start of a line", c.name, since, pos)
+			} else if c.seconds[line] < since {
+				t.Errorf("%v, since %v: started at line %v, whose time %v is before the cutoff", c.name, since, line, c.seconds[line])
+			}
+		}
+	}
+}
+
+func TestLastLineEnd(t *testing.T) {
+	long, _ := makeStartLog(seconds(1000, func(i int) int { return i }), 0)
+	cases := []struct {
+		name    string
+		content string
+		end     int64
+	}{
+		{"empty", "", 0},
+		{"complete", "ab\ncd\n", 6},
+		{"partial last line", "ab\ncd\nef", 6},
+		{"crlf", "ab\r\ncd", 4},
+		{"no newline", "abcdef", 0},
+		{"longer than the tail we search", long + "partial", int64(len(long))},
+	}
+	for _, c := range cases {
+		file := openStartLog(t, c.content)
+		s := NewScraper("host", "ownhost", "", "")
+		src := NewLogSource("test", file.Name(), parsersByName["go"])
+		src.StartPolicy = startPolicy{kind: startEnd}
+		end, err := s.startPosition(file, src, int64(len(c.content)))
+		if err != nil {
+			t.Errorf("%v: %v", c.name, err)
+		} else if end != c.end {
+			t.Errorf("%v: started at %v, expected %v", c.name, end, c.end)
+		}
+	}
+}
+
+func TestParseStartPolicy(t *testing.T) {
+	cases := []struct {
+		str      string
+		expected startPolicy
+		fail     bool
+	}{
+		{str: "", expected: startPolicy{kind: startBeginning}},
+		{str: "Beginning", expected: startPolicy{kind: startBeginning}},
+		{str: " end ", expected: startPolicy{kind: startEnd}},
+		{str: "since 36h", expected: startPolicy{kind: startSince, age: 36 * time.Hour}},
+		{str: "since 7d", expected: startPolicy{kind: startSince, age: 7 * 24 * time.Hour}},
+		{str: "since 2019-05-01", expected: startPolicy{kind: startSince, since: time.Date(2019, 5, 1, 0, 0, 0, 0, time.Local)}},
+		{str: "since 2019-05-01T10:00:00Z", expected: startPolicy{kind: startSince, since: time.Date(2019, 5, 1, 10, 0, 0, 0, time.UTC)}},
+		{str: "since", fail: true},
+		{str: "since yesterday", fail: true},
+		{str: "after 36h", fail: true},
+		{str: "middle", fail: true},
+	}
+	for _, c := range cases {
+		policy, err := parseStartPolicy(c.str)
+		if c.fail {
+			if err == nil {
+				t.Errorf("parseStartPolicy(%q) should have failed", c.str)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseStartPolicy(%q): %v", c.str, err)
+		} else if policy.kind != c.expected.kind || policy.age != c.expected.age || !policy.since.Equal(c.expected.since) {
+			t.Errorf("parseStartPolicy(%q) = %v, expected %v", c.str, policy, c.expected)
+		}
+	}
+}
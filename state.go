@@ -0,0 +1,284 @@
+package logscraper
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+/*
+Everything that we need to resume after a restart lives behind the StateStore interface.
+There are two implementations:
+
+json: A single JSON file, which is rewritten in full on every commit. This is the original
+format, and is still the default, because it's easy to inspect and edit by hand.
+
+bolt: An embedded bbolt database, which only writes the entries that changed. This is
+better for hosts with many sources.
+
+Both backends apply a commit as a single transaction, so that a crash never leaves a
+mixture of old and new entries.
+
+The JSON file is protected in two ways:
+
+1. It is never written in place. We write a temporary file next to it, fsync it, and
+rename it over the real one, so a crash leaves either the old or the new state.
+
+2. Before replacing the state file, we rename the previous one to <name>.bak, provided
+that it is readable. If the state file is missing or unreadable at startup, we fall back
+to the backup.
+*/
+
+// Bump this whenever the layout of stateJson changes, and teach migrateState about the old layout
+const stateVersion = 2
+
+const (
+	StateBackendJson = "json"
+	StateBackendBolt = "bolt"
+)
+
+/*
+SourceState is what we remember about a single log file.
+
+Entries are keyed by the logical source name plus the identity of the file (see stateKey),
+rather than by filename. This means that a config edit which changes the spelling of a path
+(case, slashes, a symlink) doesn't lose our position, and two sources that point at the same
+file each keep their own position.
+
+Entries written before version 2 were keyed by filename, and have no Name. loadState migrates
+them to the new keys.
+*/
+type SourceState struct {
+	Name      string           `json:",omitempty"` // LogSource.Name
+	Filename  string           `json:",omitempty"` // The path that the file was last opened by
+	Identity  string           `json:",omitempty"` // See fileIdentity
+	FirstLine []byte           // Signature of the file, so that we can recognize it after it has been rolled
+	LastPos   int64            // High-water mark
+	Relays    map[string]int64 `json:",omitempty"` // Position up to which each relay has accepted our messages
+}
+
+type StateStore interface {
+	// Return all saved entries
+	Load() (map[string]SourceState, error)
+	// Store the entries in put, and remove the entries named in remove, as a single transaction
+	Commit(put map[string]SourceState, remove []string) error
+	Close() error
+}
+
+// Open the state store of the given backend type. The json backend uses filename as is. The
+// bolt backend replaces its extension with .db, and imports the json file if the database is new.
+func OpenStateStore(backend, filename string, logf func(msg string, params ...interface{})) (StateStore, error) {
+	switch backend {
+	case "", StateBackendJson:
+		return NewJsonStateStore(filename, logf), nil
+	case StateBackendBolt:
+		dbFilename := strings.TrimSuffix(filename, filepath.Ext(filename)) + ".db"
+		store, err := NewBoltStateStore(dbFilename)
+		if err != nil {
+			return nil, err
+		}
+		if err := importJsonState(store, filename, logf); err != nil {
+			store.Close()
+			return nil, err
+		}
+		return store, nil
+	}
+	return nil, fmt.Errorf("Unknown state backend %v", backend)
+}
+
+// Returns the key of a source's state in the StateStore
+func stateKey(sourceName, identity string) string {
+	return sourceName + "|" + identity
+}
+
+// Returns the canonical form of a path, which we use to match legacy state entries to sources
+func normalizePath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		path = real
+	}
+	path = filepath.ToSlash(filepath.Clean(path))
+	if runtime.GOOS == "windows" {
+		path = strings.ToLower(path)
+	}
+	return path
+}
+
+// Copy the contents of a json state file into a newly created store
+func importJsonState(store StateStore, filename string, logf func(msg string, params ...interface{})) error {
+	existing, err := store.Load()
+	if err != nil || len(existing) != 0 {
+		return err
+	}
+	jstore := NewJsonStateStore(filename, logf)
+	sources, err := jstore.Load()
+	if err != nil || len(sources) == 0 {
+		return err
+	}
+	logf("Importing %v entries from state file %v", len(sources), filename)
+	return store.Commit(sources, nil)
+}
+
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+type stateJson struct {
+	Version int // See stateVersion
+	Sources map[string]SourceState
+}
+
+type jsonStateStore struct {
+	filename string
+	sources  map[string]SourceState
+	logf     func(msg string, params ...interface{})
+}
+
+func NewJsonStateStore(filename string, logf func(msg string, params ...interface{})) *jsonStateStore {
+	return &jsonStateStore{
+		filename: filename,
+		sources:  make(map[string]SourceState),
+		logf:     logf,
+	}
+}
+
+func (j *jsonStateStore) Load() (map[string]SourceState, error) {
+	jstate, err := readStateFile(j.filename)
+	if err != nil {
+		backup := stateBackupFilename(j.filename)
+		jbackup, errBackup := readStateFile(backup)
+		if errBackup != nil {
+			if os.IsNotExist(err) && os.IsNotExist(errBackup) {
+				// This is our first run
+				return map[string]SourceState{}, nil
+			}
+			return nil, err
+		}
+		j.logf("Unable to read state file %v (%v). Recovered state from backup %v", j.filename, err, backup)
+		jstate = jbackup
+	}
+	j.sources = jstate.Sources
+	all := make(map[string]SourceState, len(j.sources))
+	for key, st := range j.sources {
+		all[key] = st
+	}
+	return all, nil
+}
+
+func (j *jsonStateStore) Commit(put map[string]SourceState, remove []string) error {
+	next := make(map[string]SourceState, len(j.sources)+len(put))
+	for key, st := range j.sources {
+		next[key] = st
+	}
+	for key, st := range put {
+		next[key] = st
+	}
+	for _, key := range remove {
+		delete(next, key)
+	}
+
+	jstate := stateJson{
+		Version: stateVersion,
+		Sources: next,
+	}
+	raw, err := json.MarshalIndent(&jstate, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := writeStateFile(j.filename, raw); err != nil {
+		return err
+	}
+	j.sources = next
+	return nil
+}
+
+func (j *jsonStateStore) Close() error {
+	return nil
+}
+
+func stateBackupFilename(filename string) string {
+	return filename + ".bak"
+}
+
+// Read and parse a state file, bringing it up to date if it was written by an older version
+func readStateFile(filename string) (*stateJson, error) {
+	raw, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	jstate := &stateJson{}
+	if err := json.Unmarshal(raw, jstate); err != nil {
+		return nil, err
+	}
+	if err := migrateState(jstate); err != nil {
+		return nil, err
+	}
+	return jstate, nil
+}
+
+func migrateState(jstate *stateJson) error {
+	if jstate.Version > stateVersion {
+		return fmt.Errorf("State file version %v is newer than %v, which is the latest that we understand", jstate.Version, stateVersion)
+	}
+	if jstate.Version == 0 {
+		// Version 0 is the original layout, which had no version field. It is otherwise identical to version 1.
+		jstate.Version = 1
+	}
+	if jstate.Version == 1 {
+		// Version 1 is keyed by filename. The entries look the same as legacy entries in version 2,
+		// and loadState moves them to their new keys once it knows the file identities.
+		jstate.Version = 2
+	}
+	if jstate.Sources == nil {
+		jstate.Sources = make(map[string]SourceState)
+	}
+	return nil
+}
+
+// Replace filename with data, so that a crash at any point leaves either the old or the new
+// contents on disk. The previous contents are kept in the backup file.
+func writeStateFile(filename string, data []byte) error {
+	tmp := filename + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// Only a state file that we can read is worth keeping. We never want a corrupt file
+	// to replace a good backup.
+	if _, err := readStateFile(filename); err == nil {
+		if err := os.Rename(filename, stateBackupFilename(filename)); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(filename))
+	return nil
+}
+
+// Flush a directory entry to disk, so that a rename survives a power loss. This is a no-op on
+// Windows, where directories cannot be opened for syncing.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
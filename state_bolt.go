@@ -0,0 +1,86 @@
+package logscraper
+
+import (
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltSourcesBucket = []byte("sources")
+	boltMetaBucket    = []byte("meta")
+	boltVersionKey    = []byte("version")
+)
+
+// boltStateStore keeps one JSON-encoded SourceState per key, inside a bbolt database
+type boltStateStore struct {
+	db *bolt.DB
+}
+
+func NewBoltStateStore(filename string) (*boltStateStore, error) {
+	// The timeout stops us from hanging forever if another instance of the scraper has the database open
+	db, err := bolt.Open(filename, 0666, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltSourcesBucket); err != nil {
+			return err
+		}
+		meta, err := tx.CreateBucketIfNotExists(boltMetaBucket)
+		if err != nil {
+			return err
+		}
+		ver, _ := json.Marshal(stateVersion)
+		return meta.Put(boltVersionKey, ver)
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStateStore{db: db}, nil
+}
+
+func (b *boltStateStore) Load() (map[string]SourceState, error) {
+	all := make(map[string]SourceState)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltSourcesBucket).ForEach(func(k, v []byte) error {
+			st := SourceState{}
+			if err := json.Unmarshal(v, &st); err != nil {
+				return err
+			}
+			all[string(k)] = st
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return all, nil
+}
+
+func (b *boltStateStore) Commit(put map[string]SourceState, remove []string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltSourcesBucket)
+		for key, st := range put {
+			raw, err := json.Marshal(&st)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(key), raw); err != nil {
+				return err
+			}
+		}
+		for _, key := range remove {
+			if err := bucket.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *boltStateStore) Close() error {
+	return b.db.Close()
+}
@@ -0,0 +1,192 @@
+package logscraper
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func discardLog(msg string, params ...interface{}) {}
+
+func TestMigrateState(t *testing.T) {
+	cases := []struct {
+		name    string
+		raw     string
+		sources map[string]SourceState
+		fail    bool
+	}{
+		{
+			name:    "version 0, which has no version field",
+			raw:     `{"Sources": {"/logs/a.log": {"FirstLine": "YWJj", "LastPos": 10}}}`,
+			sources: map[string]SourceState{"/logs/a.log": {FirstLine: []byte("abc"), LastPos: 10}},
+		},
+		{
+			name:    "version 1",
+			raw:     `{"Version": 1, "Sources": {"/logs/a.log": {"FirstLine": "YWJj", "LastPos": 10}}}`,
+			sources: map[string]SourceState{"/logs/a.log": {FirstLine: []byte("abc"), LastPos: 10}},
+		},
+		{
+			name: "version 2",
+			raw:  `{"Version": 2, "Sources": {"a|1:2": {"Name": "a", "Filename": "/logs/a.log", "Identity": "1:2", "LastPos": 10, "Relays": {"r": 5}}}}`,
+			sources: map[string]SourceState{
+				"a|1:2": {Name: "a", Filename: "/logs/a.log", Identity: "1:2", LastPos: 10, Relays: map[string]int64{"r": 5}},
+			},
+		},
+		{
+			name:    "no sources",
+			raw:     `{"Version": 1}`,
+			sources: map[string]SourceState{},
+		},
+		{
+			name: "from the future",
+			raw:  `{"Version": 3, "Sources": {}}`,
+			fail: true,
+		},
+	}
+	for _, c := range cases {
+		jstate := &stateJson{}
+		if err := json.Unmarshal([]byte(c.raw), jstate); err != nil {
+			t.Fatalf("%v: %v", c.name, err)
+		}
+		err := migrateState(jstate)
+		if c.fail {
+			if err == nil {
+				t.Errorf("%v: expected migration to fail", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", c.name, err)
+			continue
+		}
+		if jstate.Version != stateVersion {
+			t.Errorf("%v: migrated to version %v, expected %v", c.name, jstate.Version, stateVersion)
+		}
+		if !jsonEqual(jstate.Sources, c.sources) {
+			t.Errorf("%v: got %+v, expected %+v", c.name, jstate.Sources, c.sources)
+		}
+	}
+}
+
+// Entries from before version 2 are keyed by filename, and move to the source's name and file
+// identity once we know what they are
+func TestRestoreLegacyState(t *testing.T) {
+	for _, version := range []string{``, `"Version": 1, `} {
+		dir := t.TempDir()
+		logFile := filepath.Join(dir, "a.log")
+		if err := ioutil.WriteFile(logFile, []byte("2020-01-01T00:00:00.000000Z [I] hello\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		stateFile := filepath.Join(dir, "state.json")
+		legacy, _ := json.Marshal(logFile)
+		raw := `{` + version + `"Sources": {` + string(legacy) + `: {"FirstLine": "YWJj", "LastPos": 10}}}`
+		if err := ioutil.WriteFile(stateFile, []byte(raw), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		s := NewScraper("host", "ownhost", stateFile, "")
+		src := NewLogSource("a", logFile, parsersByName["go"])
+		s.setSources([]*LogSource{src})
+		s.openState()
+		s.loadState()
+
+		key := stateKey("a", identifyFile(logFile))
+		if src.lastPos != 10 || src.savedKey != key {
+			t.Errorf("%v: restored position %v under %v, expected 10 under %v", raw, src.lastPos, src.savedKey, key)
+		}
+		saved, err := readStateFile(stateFile)
+		if err != nil {
+			t.Fatalf("%v: %v", raw, err)
+		}
+		if _, ok := saved.Sources[logFile]; ok || len(saved.Sources) != 1 {
+			t.Errorf("%v: the legacy entry was not replaced: %+v", raw, saved.Sources)
+		}
+		if st := saved.Sources[key]; st.Name != "a" || st.LastPos != 10 {
+			t.Errorf("%v: migrated entry is %+v", raw, st)
+		}
+	}
+}
+
+func TestJsonStateBackup(t *testing.T) {
+	good := `{"Version": 2, "Sources": {"a|1": {"Name": "a", "LastPos": 1}}}`
+	cases := []struct {
+		name    string
+		state   string // Empty means that the file doesn't exist
+		backup  string
+		lastPos int64 // Of source a, or -1 if there is no entry for it
+		fail    bool
+	}{
+		{name: "first run", lastPos: -1},
+		{name: "good state", state: `{"Version": 2, "Sources": {"a|1": {"Name": "a", "LastPos": 2}}}`, backup: good, lastPos: 2},
+		{name: "corrupt state", state: `{"Version": 2, "Sour`, backup: good, lastPos: 1},
+		{name: "missing state", backup: good, lastPos: 1},
+		{name: "state from the future", state: `{"Version": 3}`, backup: good, lastPos: 1},
+		{name: "corrupt state and no backup", state: `{"Version"`, fail: true},
+		{name: "corrupt state and backup", state: `{"Version"`, backup: `{"Version"`, fail: true},
+	}
+	for _, c := range cases {
+		filename := filepath.Join(t.TempDir(), "state.json")
+		if c.state != "" {
+			ioutil.WriteFile(filename, []byte(c.state), 0644)
+		}
+		if c.backup != "" {
+			ioutil.WriteFile(stateBackupFilename(filename), []byte(c.backup), 0644)
+		}
+		sources, err := NewJsonStateStore(filename, discardLog).Load()
+		if c.fail {
+			if err == nil {
+				t.Errorf("%v: expected Load to fail", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", c.name, err)
+			continue
+		}
+		st, ok := sources["a|1"]
+		if !ok && c.lastPos != -1 || ok && st.LastPos != c.lastPos {
+			t.Errorf("%v: loaded %+v, expected position %v", c.name, sources, c.lastPos)
+		}
+	}
+}
+
+// Every commit keeps the previous state as the backup, but a corrupt state file never
+// replaces a good backup
+func TestJsonStateCommitKeepsBackup(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "state.json")
+	store := NewJsonStateStore(filename, discardLog)
+	for pos := int64(1); pos <= 2; pos++ {
+		if err := store.Commit(map[string]SourceState{"a|1": {Name: "a", LastPos: pos}}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backup, err := readStateFile(stateBackupFilename(filename))
+	if err != nil || backup.Sources["a|1"].LastPos != 1 {
+		t.Fatalf("Backup holds %+v (%v), expected position 1", backup, err)
+	}
+
+	if err := ioutil.WriteFile(filename, []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Commit(map[string]SourceState{"a|1": {Name: "a", LastPos: 3}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if backup, err := readStateFile(stateBackupFilename(filename)); err != nil || backup.Sources["a|1"].LastPos != 1 {
+		t.Errorf("Backup holds %+v (%v) after replacing a corrupt state file, expected position 1", backup, err)
+	}
+	if state, err := readStateFile(filename); err != nil || state.Sources["a|1"].LastPos != 3 {
+		t.Errorf("State holds %+v (%v), expected position 3", state, err)
+	}
+	if _, err := os.Stat(filename + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("Temporary file was left behind: %v", err)
+	}
+}
+
+// Compare by JSON, which is how the entries are stored, so that nil and empty are the same
+func jsonEqual(a, b interface{}) bool {
+	ja, _ := json.Marshal(a)
+	jb, _ := json.Marshal(b)
+	return string(ja) == string(jb)
+}
@@ -0,0 +1,316 @@
+package logscraper
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+SyslogRelay re-emits messages as RFC 5424 syslog messages, for SIEMs that accept nothing else:
+
+	<PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID [STRUCTURED-DATA] MSG
+
+PRI combines the relay's facility with the syslog severity of the message's Level. APP-NAME is
+the name of the log source, PROCID is the process ID, and the rest of the message's fields go
+into a single structured data element (by default logscraper@32473, 32473 being the enterprise
+number that RFC 5612 reserves for documentation).
+
+Messages go over one of:
+
+	udp  One message per datagram (RFC 5426)
+	tcp  Octet-counted framing (RFC 6587)
+	tls  Octet-counted framing, over TLS (RFC 5425). caFile may name a PEM bundle of CAs to
+	     trust instead of the system's, and certFile and keyFile a client certificate.
+*/
+
+const (
+	syslogTransportUDP = "udp"
+	syslogTransportTCP = "tcp"
+	syslogTransportTLS = "tls"
+	syslogMaxUDP       = 65507 // The most that fits in an IPv4 UDP datagram
+	syslogTimeFormat   = "2006-01-02T15:04:05.000000Z07:00"
+	syslogDefaultSDID  = "logscraper@32473"
+	syslogDialTimeout  = 10 * time.Second
+	syslogWriteTimeout = 30 * time.Second
+)
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11, "ntp": 12, "security": 13, "console": 14, "solaris-cron": 15,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+type SyslogRelay struct {
+	s         *Scraper
+	Transport string
+	Address   string // host:port
+	Facility  int
+	SDID      string // The ID of our structured data element
+	BOM       bool   // Start each MSG with a UTF-8 BOM, as RFC 5424 asks, although many receivers don't expect it
+	tlsConfig *tls.Config
+	lock      sync.Mutex
+	conn      net.Conn
+}
+
+func newSyslogRelay(s *Scraper, cfg *RelayConfig) (Relay, error) {
+	opt := struct {
+		Transport          string `json:"transport"`
+		Address            string `json:"address"`
+		Facility           string `json:"facility"`
+		SDID               string `json:"sdId"`
+		BOM                bool   `json:"bom"`
+		CAFile             string `json:"caFile"`
+		CertFile           string `json:"certFile"`
+		KeyFile            string `json:"keyFile"`
+		ServerName         string `json:"serverName"`
+		InsecureSkipVerify bool   `json:"insecureSkipVerify"`
+	}{
+		Transport: syslogTransportUDP,
+		Facility:  "local0",
+		SDID:      syslogDefaultSDID,
+	}
+	if err := cfg.Decode(&opt); err != nil {
+		return nil, err
+	}
+	sr := &SyslogRelay{
+		s:         s,
+		Transport: opt.Transport,
+		Address:   opt.Address,
+		SDID:      opt.SDID,
+		BOM:       opt.BOM,
+	}
+	switch opt.Transport {
+	case syslogTransportUDP, syslogTransportTCP, syslogTransportTLS:
+	default:
+		return nil, fmt.Errorf("Unknown syslog transport %v. Expected udp, tcp or tls", opt.Transport)
+	}
+	if _, _, err := net.SplitHostPort(opt.Address); err != nil {
+		return nil, fmt.Errorf("Invalid syslog address %v: %v", opt.Address, err)
+	}
+	if facility, ok := syslogFacilities[strings.ToLower(opt.Facility)]; ok {
+		sr.Facility = facility
+	} else if n, err := strconv.Atoi(opt.Facility); err == nil && n >= 0 && n <= 23 {
+		sr.Facility = n
+	} else {
+		return nil, fmt.Errorf("Unknown syslog facility %v", opt.Facility)
+	}
+	if opt.SDID == "" || syslogName(opt.SDID, 32) != opt.SDID {
+		return nil, fmt.Errorf("Invalid syslog structured data ID %v", opt.SDID)
+	}
+
+	if opt.Transport == syslogTransportTLS {
+		sr.tlsConfig = &tls.Config{
+			ServerName:         opt.ServerName,
+			InsecureSkipVerify: opt.InsecureSkipVerify,
+		}
+		if opt.CAFile != "" {
+			pool, err := loadCertPool(opt.CAFile)
+			if err != nil {
+				return nil, err
+			}
+			sr.tlsConfig.RootCAs = pool
+		}
+		if opt.CertFile != "" || opt.KeyFile != "" {
+			cert, err := tls.LoadX509KeyPair(opt.CertFile, opt.KeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to load syslog client certificate: %v", err)
+			}
+			sr.tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+	} else if opt.CAFile != "" || opt.CertFile != "" {
+		return nil, errors.New("Certificates are only used by the tls transport")
+	}
+	return sr, nil
+}
+
+// Returns the certificates in a PEM bundle, to trust instead of the system's
+func loadCertPool(filename string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No certificates found in %v", filename)
+	}
+	return pool, nil
+}
+
+func (sr *SyslogRelay) Send(messages []*LogMsg) error {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+	if sr.Transport != syslogTransportUDP && sr.conn != nil && !syslogConnAlive(sr.conn) {
+		sr.conn.Close()
+		sr.conn = nil
+	}
+	for _, m := range messages {
+		if err := sr.write(sr.format(m)); err != nil {
+			sr.s.logMetaf("Error sending syslog to %v: %v", sr.Address, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the message in RFC 5424 form
+func (sr *SyslogRelay) format(m *LogMsg) []byte {
+	var b bytes.Buffer
+	pri := sr.Facility*8 + m.Level().Syslog()
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %s - ", pri,
+		m.Time.Format(syslogTimeFormat),
+		syslogName(string(m.Host), 255),
+		syslogName(string(m.Source), 48),
+		syslogName(string(m.ProcessID), 128))
+
+	params := []struct{ name, value string }{
+		{"severity", string(m.Severity)},
+		{"format", string(m.Format)},
+		{"ownhostname", string(m.OwnHostname)},
+		{"thread_id", string(m.ThreadID)},
+		{"client_ip", string(m.ClientIP)},
+		{"request", string(m.Request)},
+		{"response_code", string(m.ResponseCode)},
+		{"response_bytes", string(m.ResponseBytes)},
+		{"response_duration", string(m.ResponseDuration)},
+		{"java_class", string(m.JavaClass)},
+	}
+	if m.Truncated {
+		params = append(params, struct{ name, value string }{"truncated", "true"})
+	}
+	sd := false
+	for _, p := range params {
+		if p.value == "" {
+			continue
+		}
+		if !sd {
+			b.WriteString("[" + sr.SDID)
+			sd = true
+		}
+		b.WriteString(" " + p.name + "=\"")
+		syslogEscapeParam(&b, p.value)
+		b.WriteString("\"")
+	}
+	if sd {
+		b.WriteString("]")
+	} else {
+		b.WriteString("-")
+	}
+
+	if len(m.Message) != 0 {
+		b.WriteByte(' ')
+		if sr.BOM {
+			b.WriteString("\xef\xbb\xbf")
+		}
+		b.Write(bytes.TrimRight(m.Message, "\r\n"))
+	}
+	return b.Bytes()
+}
+
+// Returns str in the form of a header field, which is printable ASCII without spaces, of at most
+// max characters. Empty fields are "-".
+func syslogName(str string, max int) string {
+	if str == "" {
+		return "-"
+	}
+	b := []byte(str)
+	if len(b) > max {
+		b = b[:max]
+	}
+	for i, c := range b {
+		if c < 33 || c > 126 {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+func syslogEscapeParam(b *bytes.Buffer, value string) {
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c == '"' || c == '\\' || c == ']' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(c)
+	}
+}
+
+func (sr *SyslogRelay) write(msg []byte) error {
+	if sr.Transport == syslogTransportUDP {
+		if sr.conn == nil {
+			conn, err := net.DialTimeout("udp", sr.Address, syslogDialTimeout)
+			if err != nil {
+				return err
+			}
+			sr.conn = conn
+		}
+		if len(msg) > syslogMaxUDP {
+			msg = msg[:syslogMaxUDP]
+		}
+		_, err := sr.conn.Write(msg)
+		return err
+	}
+
+	frame := append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+	// A dropped connection may also show up as an error when we write, so we reconnect once and try again
+	for attempt := 0; ; attempt++ {
+		if sr.conn == nil {
+			conn, err := sr.dial()
+			if err != nil {
+				return err
+			}
+			sr.conn = conn
+		}
+		sr.conn.SetWriteDeadline(time.Now().Add(syslogWriteTimeout))
+		_, err := sr.conn.Write(frame)
+		if err == nil {
+			return nil
+		}
+		sr.conn.Close()
+		sr.conn = nil
+		if attempt == 1 {
+			return err
+		}
+	}
+}
+
+// Syslog servers never write to us, so if a brief read doesn't just time out, then the server has
+// closed the connection. Without this, the first message after the server closes would
+// seem to be written successfully, and be lost.
+func syslogConnAlive(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	var b [1]byte
+	_, err := conn.Read(b[:])
+	conn.SetReadDeadline(time.Time{})
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return true
+	}
+	return false
+}
+
+func (sr *SyslogRelay) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: syslogDialTimeout}
+	if sr.Transport == syslogTransportTLS {
+		return tls.DialWithDialer(dialer, "tcp", sr.Address, sr.tlsConfig)
+	}
+	return dialer.Dial("tcp", sr.Address)
+}
+
+func (sr *SyslogRelay) Close() error {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+	if sr.conn == nil {
+		return nil
+	}
+	err := sr.conn.Close()
+	sr.conn = nil
+	return err
+}
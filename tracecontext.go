@@ -0,0 +1,56 @@
+package logscraper
+
+import (
+	"bytes"
+	"regexp"
+)
+
+/*
+None of our log formats have fields for trace context, but services that take part in tracing
+write it into their messages, in one of these forms:
+
+	trace_id=4bf92f3577b34da6a3ce929d0e0e4736 span_id=00f067aa0ba902b7
+	"traceId": "4bf92f3577b34da6a3ce929d0e0e4736", "spanId": "00f067aa0ba902b7"
+	traceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+
+The keys may be spelled trace_id, trace-id, traceid or traceId, and their values may be quoted.
+
+TraceContext extracts the IDs for relays that can link a message to its trace. Most relays
+can't, so we only pay for the regexes when one of them asks.
+*/
+
+var traceIDRegex = regexp.MustCompile(`(?i)\btrace[_-]?id["']?\s*[:=]\s*["']?([0-9a-f]{32})\b`)
+var spanIDRegex = regexp.MustCompile(`(?i)\bspan[_-]?id["']?\s*[:=]\s*["']?([0-9a-f]{16})\b`)
+var traceparentRegex = regexp.MustCompile(`(?i)\b[0-9a-f]{2}-([0-9a-f]{32})-([0-9a-f]{16})-[0-9a-f]{2}\b`)
+
+// All zeros is not a valid trace or span ID
+var zeroTraceID = bytes.Repeat([]byte{'0'}, 32)
+var zeroSpanID = bytes.Repeat([]byte{'0'}, 16)
+
+// Returns the trace and span IDs that the message mentions, as lower case hex, or nil
+func (m *LogMsg) TraceContext() (traceID, spanID []byte) {
+	m.traceOnce.Do(m.extractTraceContext)
+	return m.traceID, m.spanID
+}
+
+func (m *LogMsg) extractTraceContext() {
+	if !bytes.Contains(bytes.ToLower(m.Message), []byte("trace")) {
+		return
+	}
+	if match := traceIDRegex.FindSubmatch(m.Message); match != nil {
+		m.traceID = bytes.ToLower(match[1])
+		if match := spanIDRegex.FindSubmatch(m.Message); match != nil {
+			m.spanID = bytes.ToLower(match[1])
+		}
+	} else if match := traceparentRegex.FindSubmatch(m.Message); match != nil {
+		m.traceID = bytes.ToLower(match[1])
+		m.spanID = bytes.ToLower(match[2])
+	}
+	if bytes.Equal(m.traceID, zeroTraceID) {
+		m.traceID = nil
+		m.spanID = nil
+	}
+	if bytes.Equal(m.spanID, zeroSpanID) {
+		m.spanID = nil
+	}
+}
@@ -0,0 +1,24 @@
+package logscraper
+
+import (
+	"strconv"
+	"unicode/utf8"
+)
+
+// Cut s down to at most max bytes, followed by "...". We only cut at the start of a UTF-8
+// sequence, so that we never leave half of a character behind.
+func truncateString(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	return s[:max] + "..."
+}
+
+// Parse a process or thread ID, which our logs write in hex (eg albion's 8 digit process IDs).
+// Every relay that sends them as numbers must use this, so that they all agree.
+func parseLogID(id []byte) (int64, error) {
+	return strconv.ParseInt(string(id), 16, 64)
+}
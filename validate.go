@@ -0,0 +1,287 @@
+package logscraper
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+)
+
+/*
+ValidateConfiguration checks a config file without running anything, so that a deployment
+can be gated on it (see the validate command). Unlike LoadConfiguration, it doesn't stop at the
+first problem, and every problem is reported at the line and column of the offending field.
+
+Relays are checked by creating them with their factories, and discarding them again. This is
+why factories may not connect to anything. That is left to the first Send.
+*/
+
+type ConfigDiagnostic struct {
+	Line    int
+	Column  int
+	Path    string // The field that the problem is in, eg services[0].logs[2].parser
+	Warning bool   // Warnings don't make the config invalid
+	Message string
+}
+
+func (d ConfigDiagnostic) String() string {
+	kind := "error"
+	if d.Warning {
+		kind = "warning"
+	}
+	return fmt.Sprintf("%v:%v: %v: %v: %v", d.Line, d.Column, kind, d.Path, d.Message)
+}
+
+// Returns the problems with the config file, in the order in which they appear in the file.
+// The error is only for when the file cannot be read at all.
+func (s *Scraper) ValidateConfiguration(filename string) ([]ConfigDiagnostic, error) {
+	raw, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	v := &configValidator{raw: raw, pos: make(map[string]int64)}
+
+	cfg := &ServiceRegistryConfig{}
+	if err := json.Unmarshal(raw, cfg); err != nil {
+		switch e := err.(type) {
+		case *json.SyntaxError:
+			v.addAt(e.Offset, "", false, e.Error())
+		case *json.UnmarshalTypeError:
+			v.addAt(e.Offset, e.Field, false, e.Error())
+		default:
+			v.addAt(0, "", false, err.Error())
+		}
+		return v.diags, nil
+	}
+	v.index()
+
+	if len(cfg.Services) == 0 {
+		v.add("services", false, "No services found in config file")
+	}
+	names := make(map[string]string)
+	for i, svc := range cfg.Services {
+		for j, log := range svc.Logs {
+			path := fmt.Sprintf("services[%v].logs[%v]", i, j)
+			v.validateLog(path, &log)
+			if log.Name == "" {
+				continue
+			}
+			if first, ok := names[log.Name]; ok {
+				v.add(path+".name", false, fmt.Sprintf("There is more than one log named %v (see %v)", log.Name, first))
+			} else {
+				names[log.Name] = path
+			}
+		}
+	}
+
+	v.validatePaths(&cfg.Paths)
+
+	relayNames := make(map[string]string)
+	for i := range cfg.Relays {
+		path := fmt.Sprintf("relays[%v]", i)
+		rc := &cfg.Relays[i]
+		if rc.Name == "" {
+			v.add(path, false, "Relay has no name")
+		} else if first, ok := relayNames[rc.Name]; ok {
+			v.add(path+".name", false, fmt.Sprintf("There is more than one relay named %v (see %v)", rc.Name, first))
+		} else {
+			relayNames[rc.Name] = path
+		}
+		if _, ok := relayFactories[rc.Type]; !ok {
+			v.add(path+".type", false, fmt.Sprintf("Relay type %v cannot be found", rc.Type))
+			continue
+		}
+		r, err := s.newRelay(rc)
+		if err != nil {
+			v.add(path, false, err.Error())
+			continue
+		}
+		if closer, ok := r.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+
+	sort.SliceStable(v.diags, func(i, j int) bool {
+		a, b := v.diags[i], v.diags[j]
+		return a.Line < b.Line || (a.Line == b.Line && a.Column < b.Column)
+	})
+	return v.diags, nil
+}
+
+type configValidator struct {
+	raw   []byte
+	pos   map[string]int64 // Offset of every field and array element, by path
+	diags []ConfigDiagnostic
+}
+
+func (v *configValidator) validateLog(path string, log *LogConfig) {
+	if log.Name == "" {
+		v.add(path, false, "Log has no name")
+	}
+	if _, ok := parsersByName[log.Parser]; !ok {
+		v.add(path+".parser", false, fmt.Sprintf("Parser %v cannot be found", log.Parser))
+	}
+	if _, err := lookupEncoding(log.Encoding); err != nil {
+		v.add(path+".encoding", false, err.Error())
+	}
+	if _, err := parseStartPolicy(log.StartPosition); err != nil {
+		v.add(path+".startPosition", false, err.Error())
+	}
+	if log.MaxLineSize < 0 {
+		v.add(path+".maxLineSize", false, "maxLineSize may not be negative")
+	}
+	if log.Filename == "" {
+		v.add(path, false, "Log has no filename")
+		return
+	}
+	// The log itself may not have been created yet, but its directory should be there
+	dir := filepath.Dir(log.Filename)
+	if info, err := os.Stat(dir); err != nil {
+		v.add(path+".filename", false, fmt.Sprintf("Directory %v cannot be reached: %v", dir, err))
+	} else if !info.IsDir() {
+		v.add(path+".filename", false, fmt.Sprintf("%v is not a directory", dir))
+	} else if _, err := os.Stat(log.Filename); err != nil {
+		v.add(path+".filename", true, fmt.Sprintf("%v cannot be reached: %v", log.Filename, err))
+	}
+}
+
+// Only the paths in the config are checked. Those from the environment or flags may differ on the target host.
+func (v *configValidator) validatePaths(p *Paths) {
+	dirOf := map[string]string{
+		"paths.stateFile": p.StateFile,
+		"paths.metaLog":   p.MetaLog,
+	}
+	for path, filename := range dirOf {
+		if filename == "" {
+			continue
+		}
+		dir := filepath.Dir(filename)
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			v.add(path, false, fmt.Sprintf("Directory %v cannot be reached", dir))
+		}
+	}
+	files := map[string]string{
+		"paths.hostnameFile":  p.HostnameFile,
+		"paths.datadogConfig": p.DatadogConfig,
+	}
+	for path, filename := range files {
+		if filename == "" {
+			continue
+		}
+		if _, err := os.Stat(filename); err != nil {
+			v.add(path, true, fmt.Sprintf("%v cannot be reached: %v", filename, err))
+		}
+	}
+}
+
+// Report a problem at the field with the given path. If the field is absent, we report it at
+// the closest enclosing field that is present.
+func (v *configValidator) add(path string, warning bool, msg string) {
+	at := path
+	for {
+		if off, ok := v.pos[at]; ok {
+			v.addAt(off, path, warning, msg)
+			return
+		}
+		if at == "" {
+			v.addAt(0, path, warning, msg)
+			return
+		}
+		at = parentPath(at)
+	}
+}
+
+func (v *configValidator) addAt(offset int64, path string, warning bool, msg string) {
+	line, col := lineColumn(v.raw, offset)
+	v.diags = append(v.diags, ConfigDiagnostic{
+		Line:    line,
+		Column:  col,
+		Path:    path,
+		Warning: warning,
+		Message: msg,
+	})
+}
+
+// Record the offset of every field and array element. The file is known to be valid JSON.
+func (v *configValidator) index() {
+	dec := json.NewDecoder(bytes.NewReader(v.raw))
+	v.walk(dec, "", -1)
+}
+
+// Walk the value that comes next, which lives at path. at is the offset of the field's key, or
+// -1 for array elements and the root, whose offset is that of the value itself.
+func (v *configValidator) walk(dec *json.Decoder, path string, at int64) {
+	start := v.skipSpace(dec.InputOffset())
+	tok, err := dec.Token()
+	if err != nil {
+		return
+	}
+	if at < 0 {
+		at = start
+	}
+	v.pos[path] = at
+	switch tok {
+	case json.Delim('{'):
+		for dec.More() {
+			keyStart := v.skipSpace(dec.InputOffset())
+			key, err := dec.Token()
+			if err != nil {
+				return
+			}
+			child := fmt.Sprint(key)
+			if path != "" {
+				child = path + "." + child
+			}
+			v.walk(dec, child, keyStart)
+		}
+		dec.Token()
+	case json.Delim('['):
+		for i := 0; dec.More(); i++ {
+			v.walk(dec, path+"["+strconv.Itoa(i)+"]", -1)
+		}
+		dec.Token()
+	}
+}
+
+// Skip the whitespace and separators that the decoder hasn't consumed yet
+func (v *configValidator) skipSpace(off int64) int64 {
+	for off < int64(len(v.raw)) {
+		switch v.raw[off] {
+		case ' ', '\t', '\r', '\n', ',', ':':
+			off++
+		default:
+			return off
+		}
+	}
+	return off
+}
+
+// Returns the path of the field or array that encloses path
+func parentPath(path string) string {
+	for i := len(path) - 1; i >= 0; i-- {
+		if path[i] == '.' || path[i] == '[' {
+			return path[:i]
+		}
+	}
+	return ""
+}
+
+// Returns the 1-based line and column (in characters) of offset
+func lineColumn(raw []byte, offset int64) (int, int) {
+	if offset > int64(len(raw)) {
+		offset = int64(len(raw))
+	}
+	line, lineStart := 1, 0
+	for i := 0; i < int(offset); i++ {
+		if raw[i] == '\n' {
+			line++
+			lineStart = i + 1
+		}
+	}
+	return line, utf8.RuneCount(raw[lineStart:offset]) + 1
+}
@@ -0,0 +1,152 @@
+package logscraper
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+/*
+The watcher reacts to writes, creates and renames inside the directories of our log
+sources (inotify on Linux), so that new messages are sent as soon as a burst of writes has
+been quiet for WatchDebounce, instead of up to PollInterval later. A file that is written to
+continuously is never quiet, so we scan it anyway once watchMaxDebounces periods have passed
+since the first write that we haven't scanned.
+
+We watch directories rather than the log files themselves, because the files get rolled
+underneath us. A roll shows up as a rename of the old file followed by a create of the
+new one, both of which land in the same directory watch.
+
+Notifications are not always reliable (eg network shares never report remote writes),
+so we still do a full pass over all sources every PollInterval. If the watcher cannot
+be created at all, or dies, runWatcher returns an error, and the caller falls back to
+plain polling. Both paths merely wake up the per-source workers, which go through
+runSource, so the rewind/roll handling is shared.
+*/
+
+const watchMaxDebounces = 4
+
+func (s *Scraper) runWatcher(ctx context.Context) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	dirs := map[string]bool{}
+	byFile := s.watchSources(w, dirs)
+	if len(dirs) == 0 {
+		return errors.New("No log directories could be watched")
+	}
+
+	s.logMetaf("Watching %v directories for changes", len(dirs))
+	s.wakeAllSources()
+
+	pending := map[*LogSource]bool{}
+	var deadline time.Time // When we scan the pending sources, even if they're still being written to
+	debounce := time.NewTimer(s.WatchDebounce)
+	debounce.Stop()
+	poll := time.NewTicker(s.PollInterval)
+	defer poll.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case ev, ok := <-w.Events:
+			if !ok {
+				return errors.New("File watcher closed")
+			}
+			if ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			srcs := byFile[watchKey(ev.Name)]
+			if len(srcs) == 0 {
+				continue
+			}
+			if len(pending) == 0 {
+				deadline = time.Now().Add(watchMaxDebounces * s.WatchDebounce)
+			}
+			if !debounce.Stop() {
+				select {
+				case <-debounce.C:
+				default:
+				}
+			}
+			wait := s.WatchDebounce
+			if left := time.Until(deadline); left < wait {
+				wait = left
+			}
+			debounce.Reset(wait)
+			for _, src := range srcs {
+				pending[src] = true
+			}
+		case err, ok := <-w.Errors:
+			if !ok {
+				return errors.New("File watcher closed")
+			}
+			// An overflow means we lost events, so do a full pass to catch up
+			s.logMetaf("File watcher error: %v", err)
+			if err == fsnotify.ErrEventOverflow {
+				s.wakeAllSources()
+			}
+		case <-debounce.C:
+			for src := range pending {
+				s.wakeSource(src)
+			}
+			pending = map[*LogSource]bool{}
+		case <-poll.C:
+			s.wakeAllSources()
+		case <-s.sourcesChanged:
+			// A reload replaced the sources. Retired sources may still be pending, but waking them is harmless.
+			byFile = s.watchSources(w, dirs)
+		}
+	}
+}
+
+// Add watches for the directories of all sources that aren't in dirs yet, and remove the
+// watches of directories that no longer have any sources. dirs holds the watched directories.
+// Returns the sources, keyed by watchKey.
+func (s *Scraper) watchSources(w *fsnotify.Watcher, dirs map[string]bool) map[string][]*LogSource {
+	byFile := map[string][]*LogSource{}
+	wanted := map[string]bool{}
+	for _, src := range s.sourceList() {
+		key := watchKey(src.Filename)
+		byFile[key] = append(byFile[key], src)
+		dir := filepath.Dir(src.Filename)
+		if wanted[dir] {
+			continue
+		}
+		wanted[dir] = true
+		if dirs[dir] {
+			continue
+		}
+		if err := w.Add(dir); err != nil {
+			// The directory may not exist yet. The periodic pass will still pick up the source.
+			s.logMetaf("Unable to watch %v, relying on polling for it: %v", dir, err)
+			continue
+		}
+		dirs[dir] = true
+	}
+	for dir := range dirs {
+		if !wanted[dir] {
+			w.Remove(dir)
+			delete(dirs, dir)
+		}
+	}
+	return byFile
+}
+
+// Returns the form of a filename that we use to match notifications to sources
+func watchKey(filename string) string {
+	filename = filepath.Clean(filename)
+	if runtime.GOOS == "windows" {
+		filename = strings.ToLower(filename)
+	}
+	return filename
+}
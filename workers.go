@@ -0,0 +1,182 @@
+package logscraper
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Every LogSource has its own worker goroutine, which sleeps until the poller or the
+watcher wakes it up. Workers must acquire one of MaxConcurrency slots before they touch
+their file, so a host with many sources doesn't hammer the disk (or network share).
+
+A source can hold a slot for at most MaxBytesPerPass bytes, after which it releases the
+slot and queues up again behind any other waiting sources. A source whose reads hang
+(eg a dead network share) will hold onto its slot, but the remaining slots keep the
+other sources moving.
+
+Only a source's own worker touches its position while scanning. Once a pass is done, the
+worker publishes the position with commit(), and saveState only ever reads those
+published positions, so the state file is always a consistent snapshot of completed
+passes.
+
+When the context is cancelled, workers finish the pass that they are busy with (including
+sending its messages to the relays), but don't start another one. If a pass is still
+running when the shutdown deadline expires, we abandon it without committing its position,
+so its messages are read again on the next start.
+
+Reload retires a source by closing its retire channel. The worker then keeps on scanning
+until it reaches the end of the file, so that nothing that was written before the source was
+removed is lost. If we are paused, the worker exits straight away, and leaves the rest for
+whenever the source comes back.
+*/
+
+const (
+	stateSaveInterval = 5 * time.Second
+	stateGCInterval   = time.Hour
+)
+
+func (s *Scraper) startWorkers(ctx context.Context) {
+	if s.MaxConcurrency < 1 {
+		s.MaxConcurrency = 1
+	}
+	s.slots = make(chan struct{}, s.MaxConcurrency)
+	for _, src := range s.sourceList() {
+		s.startWorker(ctx, src)
+	}
+	go s.runStateSaver(ctx)
+}
+
+func (s *Scraper) startWorker(ctx context.Context, src *LogSource) {
+	ctx, src.cancel = context.WithCancel(ctx)
+	src.retire = make(chan struct{})
+	src.done = make(chan struct{})
+	s.workers.Add(1)
+	go s.runWorker(ctx, src)
+}
+
+func (s *Scraper) runWorker(ctx context.Context, src *LogSource) {
+	defer s.workers.Done()
+	defer close(src.done)
+	retiring := false
+	for {
+		if !retiring {
+			select {
+			case <-ctx.Done():
+				return
+			case <-src.wake:
+			case <-src.retire:
+				if s.control.isPaused() {
+					return
+				}
+				retiring = true
+			}
+		}
+		// If the source is retired while we wait out a pause, then we exit straight away, as described above
+		if !s.control.enter(ctx.Done(), src.retire) {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			s.control.leave()
+			return
+		case s.slots <- struct{}{}:
+		}
+		more := s.runSource(src)
+		<-s.slots
+		s.control.leave()
+		src.commit()
+		atomic.StoreInt32(&s.stateDirty, 1)
+		if more {
+			s.wakeSource(src)
+		} else if retiring {
+			return
+		}
+	}
+}
+
+// Drain the source, and stop its worker. If that takes longer than ShutdownTimeout, then we
+// abandon the source where it is.
+func (s *Scraper) retireWorker(src *LogSource) {
+	close(src.retire)
+	timeout := time.NewTimer(s.ShutdownTimeout)
+	defer timeout.Stop()
+	select {
+	case <-src.done:
+	case <-timeout.C:
+		s.logMetaf("Timed out after %v waiting for %v to finish", s.ShutdownTimeout, src.Name)
+	}
+	src.cancel()
+}
+
+// Wait for the workers to finish their current passes, flush the relays, and save our state.
+// This is called once the context that was given to the workers has been cancelled.
+func (s *Scraper) shutdown() {
+	s.logMetaf("Scraper shutting down")
+	// Wait for any reload in progress, so that it doesn't start workers while we wait for them
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), s.ShutdownTimeout)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		s.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		s.logMetaf("Timed out after %v waiting for sources to finish. Their unsent messages will be read again on the next start.", s.ShutdownTimeout)
+	}
+
+	for name, err := range FlushAllRelayers(ctx) {
+		if err != nil {
+			s.logMetaf("Unable to flush relay %v: %v", name, err)
+		}
+	}
+
+	s.saveState()
+	if s.state != nil {
+		if err := s.state.Close(); err != nil {
+			s.logMetaf("Error closing state: %v", err)
+		}
+	}
+}
+
+// Ask the source's worker to scan it. If a scan is already queued, then this does nothing.
+func (s *Scraper) wakeSource(src *LogSource) {
+	select {
+	case src.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Scraper) wakeAllSources() {
+	for _, src := range s.sourceList() {
+		s.wakeSource(src)
+	}
+}
+
+// Write out the state whenever a worker has made progress, and occasionally clean out stale entries.
+// The final save during shutdown is done by shutdown().
+func (s *Scraper) runStateSaver(ctx context.Context) {
+	ticker := time.NewTicker(stateSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if atomic.SwapInt32(&s.stateDirty, 0) != 0 {
+			s.saveState()
+		}
+		if s.state != nil && time.Since(s.stateGCTime) > stateGCInterval {
+			if saved, err := s.state.Load(); err == nil {
+				s.collectStateGarbage(saved)
+			}
+		}
+	}
+}